@@ -0,0 +1,343 @@
+// lsmctl是检查和操作LSM数据目录的命令行工具。
+//
+// 读取数据的命令（get、scan、stats）通过Reader只读地访问目录，可以在LSM运行时使用；
+// 修改数据的命令（set、delete、compact）需要获取目录的写锁，只能在LSM停止时使用；
+// dump-*命令直接解析单个数据文件，verify检查目录中所有数据文件的完整性，repair修复发现的问题并且同样需要写锁
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/RitterHou/lsm/lsm"
+)
+
+const usage = `Usage: lsmctl [-dir DIR] [-family NAME] COMMAND [ARGS]
+
+Commands:
+  get KEY                                  print the value of KEY
+  set KEY VALUE                            set KEY to VALUE
+  delete KEY                               delete KEY
+  scan [-prefix P] [-start S] [-end E] [-limit N]
+                                           print keys and values in order
+  stats                                    print statistics of the data
+  compact [-start S] [-end E]              compact segments overlapping [S, E)
+  dump-segment FILE                        print all records in a segment file
+  dump-index FILE                          print all entries in an index file
+  dump-translog FILE                       print all records in a transLog file
+  verify                                   check all data files in the directory
+  repair                                   fix the problems found by verify
+  rebuild-index FILE                       regenerate the index of a segment file
+`
+
+var errUsage = errors.New("invalid arguments")
+
+func main() {
+	err := run(os.Args[1:], os.Stdout)
+	if err == errUsage {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "lsmctl: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+// 执行一条命令，结果写到w中
+func run(args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("lsmctl", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	dir := flags.String("dir", ".", "data directory")
+	family := flags.String("family", "", "column family, the default column family if empty")
+	if err := flags.Parse(args); err != nil || flags.NArg() == 0 {
+		return errUsage
+	}
+	ctl := &ctl{dir: *dir, family: *family, w: w}
+	command, args := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "get":
+		return ctl.get(args)
+	case "set":
+		return ctl.set(args)
+	case "delete":
+		return ctl.delete(args)
+	case "scan":
+		return ctl.scan(args)
+	case "stats":
+		return ctl.stats(args)
+	case "compact":
+		return ctl.compact(args)
+	case "dump-segment":
+		return ctl.dumpSegment(args)
+	case "dump-index":
+		return ctl.dumpIndex(args)
+	case "dump-translog":
+		return ctl.dumpTransLog(args)
+	case "verify":
+		return ctl.verify(args)
+	case "repair":
+		return ctl.repair(args)
+	case "rebuild-index":
+		return ctl.rebuildIndex(args)
+	}
+	return errUsage
+}
+
+type ctl struct {
+	dir    string
+	family string
+	w      io.Writer
+}
+
+// 列族的数据目录
+func (c *ctl) familyDir() string {
+	if c.family == "" {
+		return c.dir
+	}
+	return path.Join(c.dir, c.family)
+}
+
+// 只读地打开列族，LSM运行时也可以使用
+func (c *ctl) openReader() (*lsm.Reader, error) {
+	if _, err := os.Stat(c.familyDir()); err != nil {
+		return nil, err
+	}
+	return lsm.NewLsmReaderWithOptions(c.familyDir(), lsm.Options{TailTransLog: true})
+}
+
+// 获取写锁打开列族，执行f之后关闭LSM
+func (c *ctl) write(f func(cf *lsm.ColumnFamily) error) error {
+	if _, err := os.Stat(c.familyDir()); err != nil {
+		return err
+	}
+	db, err := lsm.NewLsm(c.dir, false)
+	if err != nil {
+		return err
+	}
+	cf := db.ColumnFamily
+	if c.family != "" {
+		cf, err = db.OpenColumnFamily(c.family, lsm.Options{})
+	}
+	if err == nil {
+		err = f(cf)
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (c *ctl) get(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	reader, err := c.openReader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	value, ok, err := reader.GetContext(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("key not found: " + args[0])
+	}
+	fmt.Fprintln(c.w, value)
+	return nil
+}
+
+func (c *ctl) set(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	return c.write(func(cf *lsm.ColumnFamily) error {
+		return cf.Set(args[0], args[1])
+	})
+}
+
+func (c *ctl) delete(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return c.write(func(cf *lsm.ColumnFamily) error {
+		return cf.Delete(args[0])
+	})
+}
+
+func (c *ctl) scan(args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	prefix := flags.String("prefix", "", "only print keys with the prefix")
+	start := flags.String("start", "", "first key to print")
+	end := flags.String("end", "", "stop before this key")
+	limit := flags.Int("limit", 0, "maximum number of keys to print, 0 means no limit")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+	reader, err := c.openReader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	// 只有按照字节序排列时具有相同前缀的key才是相邻的，其他比较器需要检查范围内所有的key
+	bytewise := reader.Comparator().Name() == lsm.BytewiseComparator.Name()
+	if bytewise && *prefix != "" && *start < *prefix {
+		*start = *prefix
+	}
+	count := 0
+	reader.Scan(*start, *end, func(key string, value string) bool {
+		if !strings.HasPrefix(key, *prefix) {
+			// 字节序中前缀之后的key都不再有该前缀
+			return !bytewise
+		}
+		fmt.Fprintf(c.w, "%q\t%q\n", key, value)
+		count += 1
+		return *limit == 0 || count < *limit
+	})
+	return nil
+}
+
+func (c *ctl) stats(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	reader, err := c.openReader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	stats := reader.Stats()
+	fmt.Fprintf(c.w, "segments\t%d\n", stats.Segments)
+	fmt.Fprintf(c.w, "segment_bytes\t%d\n", stats.SegmentBytes)
+	fmt.Fprintf(c.w, "translog_bytes\t%d\n", stats.TransLogBytes)
+	fmt.Fprintf(c.w, "translog_records\t%d\n", stats.MemTableEntries)
+	fmt.Fprintf(c.w, "translog_record_bytes\t%d\n", stats.MemTableBytes)
+	fmt.Fprintf(c.w, "blocks\t%d\n", stats.Compression.Blocks)
+	fmt.Fprintf(c.w, "raw_bytes\t%d\n", stats.Compression.RawBytes)
+	fmt.Fprintf(c.w, "compressed_bytes\t%d\n", stats.Compression.CompressedBytes)
+	fmt.Fprintf(c.w, "compression_ratio\t%.3f\n", stats.Compression.Ratio())
+	return nil
+}
+
+func (c *ctl) compact(args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	start := flags.String("start", "", "smallest key of the range, empty means no lower bound")
+	end := flags.String("end", "", "end of the range (exclusive), empty means no upper bound")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+	return c.write(func(cf *lsm.ColumnFamily) error {
+		return cf.CompactRange(*start, *end)
+	})
+}
+
+func (c *ctl) dumpSegment(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return lsm.ReadSegment(args[0], func(offset uint32, r lsm.Record) bool {
+		fmt.Fprintf(c.w, "%d\t%s\n", offset, formatRecord(r))
+		return true
+	})
+}
+
+func (c *ctl) dumpIndex(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	indices, err := lsm.ReadIndex(args[0])
+	if err != nil {
+		return err
+	}
+	for _, index := range indices {
+		fmt.Fprintf(c.w, "%d\t%q\n", index.Offset(), index.Key())
+	}
+	return nil
+}
+
+func (c *ctl) dumpTransLog(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	discarded, err := lsm.ReadTransLog(args[0], func(entry int, r lsm.Record) bool {
+		fmt.Fprintf(c.w, "%d\t%s\t%s\n", entry, r.Family, formatRecord(r))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if discarded > 0 {
+		fmt.Fprintf(c.w, "incomplete entry\t%d bytes\n", discarded)
+	}
+	return nil
+}
+
+// 记录的格式：类型 时间戳 存活时长 key value，key和value带引号
+func formatRecord(r lsm.Record) string {
+	ttl := "-"
+	if r.TTL > 0 {
+		ttl = r.TTL.String()
+	}
+	return r.Kind + "\t" + strconv.FormatUint(r.Timestamp, 10) + "\t" + ttl + "\t" + strconv.Quote(r.Key) + "\t" + strconv.Quote(r.Value)
+}
+
+// 检查目录以及所有列族目录中的数据文件
+func (c *ctl) verify(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	report, err := lsm.Verify(c.dir)
+	if err != nil {
+		return err
+	}
+	return c.printReport(report)
+}
+
+// 修复目录以及所有列族目录中的数据文件
+func (c *ctl) repair(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	report, err := lsm.Repair(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, action := range report.Actions {
+		fmt.Fprintln(c.w, "repaired: "+action)
+	}
+	// 修复之前发现的问题都已经被处理
+	fmt.Fprintf(c.w, "fixed %d problems\n", len(report.Problems))
+	return nil
+}
+
+func (c *ctl) rebuildIndex(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return lsm.RebuildIndex(args[0])
+}
+
+func (c *ctl) printReport(report *lsm.VerifyReport) error {
+	for _, dir := range report.Unordered {
+		fmt.Fprintln(c.w, "skipped key order check: "+dir)
+	}
+	for _, problem := range report.Problems {
+		fmt.Fprintln(c.w, problem.String())
+	}
+	if !report.OK() {
+		return fmt.Errorf("found %d problems", len(report.Problems))
+	}
+	fmt.Fprintf(c.w, "ok: %d segments, %d records\n", report.Segments, report.Records)
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/RitterHou/lsm/lsm"
+)
+
+type commandTest struct {
+	name     string
+	args     []string
+	output   string // 期望的输出
+	contains bool   // 为true时只要求输出包含output
+	fail     bool   // 命令是否应该返回错误
+}
+
+// 依次执行一组命令并检查它们的输出
+func runCommands(t *testing.T, tests []commandTest) {
+	for _, test := range tests {
+		var out bytes.Buffer
+		err := run(test.args, &out)
+		if (err != nil) != test.fail {
+			t.Fatalf("%s: unexpected error %v", test.name, err)
+		}
+		output := out.String()
+		if (test.contains && !strings.Contains(output, test.output)) || (!test.contains && output != test.output) {
+			t.Fatalf("%s: expected %q, got %q", test.name, test.output, output)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	db, err := lsm.NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("user:1", "alice")
+	db.Set("user:2", "bob")
+	db.Set("item:1", "book")
+	users, err := db.OpenColumnFamily("users", lsm.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users.Set("u", "1")
+	db.Close()
+	segFilePath, indexFilePath := path.Join(dir, "0.seg"), path.Join(dir, "0.i")
+
+	runCommands(t, []commandTest{
+		{"no command", []string{"-dir", dir}, "", false, true},
+		{"unknown command", []string{"-dir", dir, "unknown"}, "", false, true},
+		{"get", []string{"-dir", dir, "get", "user:1"}, "alice\n", false, false},
+		{"get missing key", []string{"-dir", dir, "get", "user:3"}, "", false, true},
+		{"get missing family", []string{"-dir", dir, "-family", "orders", "get", "u"}, "", false, true},
+		{"get family", []string{"-dir", dir, "-family", "users", "get", "u"}, "1\n", false, false},
+		{"scan", []string{"-dir", dir, "scan"}, "\"item:1\"\t\"book\"\n\"user:1\"\t\"alice\"\n\"user:2\"\t\"bob\"\n", false, false},
+		{"scan prefix", []string{"-dir", dir, "scan", "-prefix", "user:"}, "\"user:1\"\t\"alice\"\n\"user:2\"\t\"bob\"\n", false, false},
+		{"scan range", []string{"-dir", dir, "scan", "-start", "item:2", "-end", "user:2"}, "\"user:1\"\t\"alice\"\n", false, false},
+		{"scan limit", []string{"-dir", dir, "scan", "-limit", "1"}, "\"item:1\"\t\"book\"\n", false, false},
+		{"scan invalid flag", []string{"-dir", dir, "scan", "-unknown"}, "", false, true},
+		{"stats", []string{"-dir", dir, "stats"}, "segments\t1\n", true, false},
+		{"dump segment", []string{"dump-segment", segFilePath}, "value\t", true, false},
+		{"dump index", []string{"dump-index", indexFilePath}, "0\t\"user:2\"\n", false, false},
+		{"verify", []string{"-dir", dir, "verify"}, "ok: 2 segments, 4 records\n", false, false},
+	})
+
+	// 删除索引之后verify报告问题，rebuild-index重新生成索引
+	os.Remove(indexFilePath)
+	runCommands(t, []commandTest{
+		{"verify missing index", []string{"-dir", dir, "verify"}, "", true, true},
+		{"rebuild index", []string{"rebuild-index", segFilePath}, "", false, false},
+		{"dump rebuilt index", []string{"dump-index", indexFilePath}, "0\t\"user:2\"\n", false, false},
+		{"verify rebuilt index", []string{"-dir", dir, "verify"}, "ok: 2 segments, 4 records\n", false, false},
+	})
+
+	runCommands(t, []commandTest{
+		{"set", []string{"-dir", dir, "set", "user:3", "carol"}, "", false, false},
+		{"get after set", []string{"-dir", dir, "get", "user:3"}, "carol\n", false, false},
+		{"delete", []string{"-dir", dir, "delete", "user:1"}, "", false, false},
+		{"get after delete", []string{"-dir", dir, "get", "user:1"}, "", false, true},
+		{"compact", []string{"-dir", dir, "compact"}, "", false, false},
+		{"scan after compact", []string{"-dir", dir, "scan", "-prefix", "user:"}, "\"user:2\"\t\"bob\"\n\"user:3\"\t\"carol\"\n", false, false},
+		{"rebuild missing segment", []string{"rebuild-index", path.Join(dir, "100.seg")}, "", false, true},
+		{"repair", []string{"-dir", dir, "repair"}, "fixed 0 problems\n", false, false},
+	})
+}
+
+func TestReadWhileRunning(t *testing.T) {
+	dir := t.TempDir()
+	db, err := lsm.NewLsm(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Set("a", "1")
+	db.Set("b", "2")
+
+	runCommands(t, []commandTest{
+		{"get from transLog", []string{"-dir", dir, "get", "a"}, "1\n", false, false},
+		{"stats records", []string{"-dir", dir, "stats"}, "translog_records\t2\n", true, false},
+		{"dump transLog", []string{"dump-translog", path.Join(dir, "translog")}, "0\tdefault\tvalue\t", true, false},
+		{"write while locked", []string{"-dir", dir, "set", "c", "3"}, "", false, true},
+	})
+	var out bytes.Buffer
+	if err := run([]string{"-dir", dir, "stats"}, &out); err != nil || strings.Contains(out.String(), "translog_bytes\t0\n") {
+		t.Fatal("stats should report the size of the transLog", out.String())
+	}
+}
+
+func TestScanPrefixWithComparator(t *testing.T) {
+	dir := t.TempDir()
+	db, err := lsm.NewLsmWithOptions(dir, lsm.Options{Comparator: lsm.ReverseBytewiseComparator})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a1", "b1", "b2", "c1"} {
+		db.Set(key, "v"+key)
+	}
+	db.Close()
+
+	runCommands(t, []commandTest{
+		{"scan reverse", []string{"-dir", dir, "scan", "-limit", "2"}, "\"c1\"\t\"vc1\"\n\"b2\"\t\"vb2\"\n", false, false},
+		{"scan reverse prefix", []string{"-dir", dir, "scan", "-prefix", "b"}, "\"b2\"\t\"vb2\"\n\"b1\"\t\"vb1\"\n", false, false},
+	})
+}
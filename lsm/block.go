@@ -0,0 +1,477 @@
+package lsm
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 数据块的压缩算法，会被记录在每个数据块的头部
+type Compression byte
+
+const (
+	NoCompression    Compression = iota // 不进行压缩
+	FlateCompression                    // 使用flate算法进行压缩
+)
+
+const (
+	blockHeaderSize     = 9    // 数据块头部的大小：压缩算法(1) + 原始长度(4) + 压缩后长度(4)
+	maxCompressionRatio = 1032 // flate算法能够达到的最大压缩比，用于检查数据块头部中的原始长度是否合理
+)
+
+// 段文件的压缩统计信息
+type CompressionStats struct {
+	Blocks          uint64 // 数据块的数量
+	RawBytes        uint64 // 数据块压缩前的总大小
+	CompressedBytes uint64 // 数据块压缩后的总大小（包含头部）
+}
+
+// 压缩率，即压缩后的大小与原始大小的比值，越小说明压缩效果越好
+func (s CompressionStats) Ratio() float64 {
+	if s.RawBytes == 0 {
+		return 1
+	}
+	return float64(s.CompressedBytes) / float64(s.RawBytes)
+}
+
+// 把原始数据块编码为段文件中的格式：头部 + 压缩后的数据
+func encodeBlock(compression Compression, raw []byte) []byte {
+	data := raw
+	if compression == FlateCompression {
+		var buf bytes.Buffer
+		writer, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = writer.Write(raw)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = writer.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		data = buf.Bytes()
+	}
+	// 压缩后反而变大的数据块直接保存原始数据
+	if len(data) >= len(raw) {
+		compression = NoCompression
+		data = raw
+	}
+
+	block := make([]byte, 0, blockHeaderSize+len(data))
+	block = append(block, byte(compression))
+	block = append(block, uint32ToBytes(uint32(len(raw)))...)
+	block = append(block, uint32ToBytes(uint32(len(data)))...)
+	return append(block, data...)
+}
+
+// 解压数据块
+func decompressBlock(compression Compression, data []byte, rawLength uint32) ([]byte, error) {
+	switch compression {
+	case NoCompression:
+		return data, nil
+	case FlateCompression:
+		reader := flate.NewReader(bytes.NewReader(data))
+		raw := make([]byte, rawLength)
+		if _, err := io.ReadFull(reader, raw); err != nil {
+			return nil, err
+		}
+		return raw, reader.Close()
+	}
+	return nil, errors.New("unknown compression type " + strconv.Itoa(int(compression)))
+}
+
+// 读取段文件中指定偏移处数据块的头部，返回压缩算法，原始长度和压缩后的长度
+func readBlockHeader(file *os.File, offset uint32) (Compression, uint32, uint32) {
+	header := make([]byte, blockHeaderSize)
+	_, err := file.ReadAt(header, int64(offset))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return Compression(header[0]), binary.LittleEndian.Uint32(header[1:]), binary.LittleEndian.Uint32(header[5:])
+}
+
+// 读取段文件中指定偏移处的数据块，返回解压后的内容以及该数据块在段文件中占用的长度
+func readBlock(file *os.File, offset uint32) ([]byte, uint32) {
+	compression, rawLength, length := readBlockHeader(file, offset)
+	data := make([]byte, length)
+	_, err := file.ReadAt(data, int64(offset)+blockHeaderSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	raw, err := decompressBlock(compression, data, rawLength)
+	if err != nil {
+		log.Fatal(file.Name() + ": " + err.Error())
+	}
+	return raw, blockHeaderSize + length
+}
+
+// 数据块的构建器，块内的key只保存与前一个key不同的后缀部分，
+// 每隔blockRestartInterval条记录设置一个保存完整key的重启点，用于在块内进行二分查找
+type blockBuilder struct {
+	buf      []byte   // 数据块中的记录部分
+	restarts []uint32 // 重启点在数据块中的偏移
+	counter  int      // 距离上一个重启点的记录数
+	lastKey  string   // 上一条记录的key
+}
+
+// 添加一条记录，记录必须按照key的顺序添加
+func (b *blockBuilder) add(key string, data Data) {
+	shared := 0
+	if b.counter < blockRestartInterval && len(b.buf) > 0 {
+		// 计算与上一个key的公共前缀长度
+		for shared < len(key) && shared < len(b.lastKey) && key[shared] == b.lastKey[shared] {
+			shared += 1
+		}
+	} else {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+		b.counter = 0
+	}
+	b.buf = appendUvarint(b.buf, uint64(shared))
+	b.buf = appendUvarint(b.buf, uint64(len(key)-shared))
+	b.buf = appendUvarint(b.buf, uint64(len(data.value)))
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, data.value...)
+	b.buf = append(b.buf, uint64ToBytes(data.timestamp)...)
+	b.buf = append(b.buf, data.kind)
+	b.buf = appendUvarint(b.buf, data.ttl)
+	b.counter += 1
+	b.lastKey = key
+}
+
+// 当前数据块的大小
+func (b *blockBuilder) size() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+// 生成数据块：记录 + 重启点偏移列表 + 重启点数量，并重置构建器
+func (b *blockBuilder) finish() []byte {
+	raw := b.buf
+	for _, restart := range b.restarts {
+		raw = append(raw, uint32ToBytes(restart)...)
+	}
+	raw = append(raw, uint32ToBytes(uint32(len(b.restarts)))...)
+	*b = blockBuilder{}
+	return raw
+}
+
+// 数据块的迭代器
+type blockIterator struct {
+	buf      []byte   // 数据块中的记录部分
+	restarts []uint32 // 重启点在数据块中的偏移
+	offset   uint32   // 下一条记录的偏移
+	key      string
+	data     Data
+}
+
+func newBlockIterator(raw []byte) *blockIterator {
+	numRestarts := binary.LittleEndian.Uint32(raw[len(raw)-4:])
+	restartsOffset := uint32(len(raw)) - 4 - 4*numRestarts
+	restarts := make([]uint32, numRestarts)
+	for i := range restarts {
+		restarts[i] = binary.LittleEndian.Uint32(raw[restartsOffset+4*uint32(i):])
+	}
+	return &blockIterator{buf: raw[:restartsOffset], restarts: restarts}
+}
+
+// 读取下一条记录，没有更多的记录时返回false
+func (it *blockIterator) next() bool {
+	if int(it.offset) >= len(it.buf) {
+		return false
+	}
+	buf := it.buf[it.offset:]
+	shared, n1 := binary.Uvarint(buf)
+	unshared, n2 := binary.Uvarint(buf[n1:])
+	valueLength, n3 := binary.Uvarint(buf[n1+n2:])
+	buf = buf[n1+n2+n3:]
+
+	it.key = it.key[:shared] + string(buf[:unshared])
+	buf = buf[unshared:]
+	it.data = Data{
+		value:     string(buf[:valueLength]),
+		timestamp: binary.LittleEndian.Uint64(buf[valueLength:]),
+		kind:      buf[valueLength+8],
+	}
+	ttl, n4 := binary.Uvarint(buf[valueLength+9:])
+	it.data.ttl = ttl
+	it.offset += uint32(n1+n2+n3+n4) + uint32(unshared+valueLength) + 9
+	return true
+}
+
+// 定位到第一个不小于key的记录，不存在这样的记录时返回false
+func (it *blockIterator) seek(comparator Comparator, key string) bool {
+	// 重启点保存的是完整的key，二分查找出最后一个key小于目标key的重启点
+	i := sort.Search(len(it.restarts), func(i int) bool {
+		it.offset = it.restarts[i]
+		it.key = ""
+		it.next()
+		return comparator.Compare(it.key, key) >= 0
+	})
+	if i > 0 {
+		i -= 1
+	}
+	// 从该重启点开始顺序查找
+	it.offset = it.restarts[i]
+	it.key = ""
+	for it.next() {
+		if comparator.Compare(it.key, key) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 通过索引文件去对应的段文件中检索key时间戳不大于timestamp的最新版本
+func searchSegment(cache *BlockCache, comparator Comparator, indexFilePath string, key string, timestamp uint64) (Data, bool) {
+	var result Data
+	found := false
+	scanSegment(cache, comparator, indexFilePath, key, func(data Data) bool {
+		if data.timestamp <= timestamp {
+			result = data
+			found = true
+			return false
+		}
+		return true
+	})
+	return result, found
+}
+
+// 按照时间戳从新到旧的顺序访问段文件中key的所有版本，直到visit返回false，优先从缓存中读取数据块
+func scanSegment(cache *BlockCache, comparator Comparator, indexFilePath string, key string, visit func(data Data) bool) {
+	reader := newSegmentReader(cache, comparator, indexFilePath)
+	defer reader.close()
+	reader.scan(key, 0, visit)
+}
+
+// 在一组段文件中查找多个key时间戳不大于timestamp的最新记录，keys需要按照比较器排好序，结果和keys的顺序一致。
+// 每个段文件由一个goroutine并行查找
+func searchSegmentsBatch(cache *BlockCache, comparator Comparator, indexFilesPath []string, keys []string, timestamp uint64) []rowCacheEntry {
+	entries := make([]rowCacheEntry, len(keys))
+	if len(keys) == 0 {
+		return entries
+	}
+	results := make([][]rowCacheEntry, len(indexFilesPath))
+	var wg sync.WaitGroup
+	for i, indexFilePath := range indexFilesPath {
+		wg.Add(1)
+		go func(i int, indexFilePath string) {
+			defer wg.Done()
+			results[i] = searchSegmentBatch(cache, comparator, indexFilePath, keys, timestamp)
+		}(i, indexFilePath)
+	}
+	wg.Wait()
+	// 每个key取所有段文件中时间戳最大的记录
+	for _, result := range results {
+		for i, entry := range result {
+			if entry.found && (!entries[i].found || entry.data.timestamp > entries[i].data.timestamp) {
+				entries[i] = entry
+			}
+		}
+	}
+	return entries
+}
+
+// 在一个段文件中依次查找多个排好序的key，索引文件只读取一次，并且查找每个key时都从上一个key所在的数据块开始
+func searchSegmentBatch(cache *BlockCache, comparator Comparator, indexFilePath string, keys []string, timestamp uint64) []rowCacheEntry {
+	entries := make([]rowCacheEntry, len(keys))
+	reader := newSegmentReader(cache, comparator, indexFilePath)
+	defer reader.close()
+	from := 0
+	for i, key := range keys {
+		entry := &entries[i]
+		from = reader.scan(key, from, func(data Data) bool {
+			if data.timestamp <= timestamp {
+				entry.data = data
+				entry.found = true
+				return false
+			}
+			return true
+		})
+	}
+	return entries
+}
+
+// 段文件的读取器，索引文件在创建时读取一次，段文件在第一次需要读取数据块时才打开
+type segmentReader struct {
+	cache       *BlockCache
+	comparator  Comparator
+	segFilePath string
+	indices     []Index
+	segFile     *os.File
+	lastBlock   int    // 最近一次读取的数据块的序号
+	block       []byte // 最近一次读取的数据块
+}
+
+func newSegmentReader(cache *BlockCache, comparator Comparator, indexFilePath string) *segmentReader {
+	indexData, err := ioutil.ReadFile(indexFilePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &segmentReader{
+		cache:       cache,
+		comparator:  comparator,
+		segFilePath: strings.Replace(indexFilePath, indexFileSuffix, segmentFileSuffix, -1),
+		indices:     getIndexList(indexData),
+		lastBlock:   -1,
+	}
+}
+
+// 读取第i个数据块，优先从缓存中读取
+func (r *segmentReader) readBlock(i int) []byte {
+	if i == r.lastBlock {
+		return r.block
+	}
+	block, ok := r.cache.get(r.segFilePath, r.indices[i].offset)
+	if !ok {
+		if r.segFile == nil {
+			segFile, err := os.Open(r.segFilePath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			r.segFile = segFile
+		}
+		block, _ = readBlock(r.segFile, r.indices[i].offset)
+		r.cache.set(r.segFilePath, r.indices[i].offset, block)
+	}
+	r.lastBlock, r.block = i, block
+	return block
+}
+
+// 从第from个数据块开始按照时间戳从新到旧的顺序访问key的所有版本，直到visit返回false。
+// 返回key可能存在的第一个数据块的序号，之后查找更大的key时可以从该数据块开始
+func (r *segmentReader) scan(key string, from int, visit func(data Data) bool) int {
+	// 索引中记录的是每个数据块的最后一个key，第一个不小于key的数据块就是key可能存在的数据块
+	first := from + sort.Search(len(r.indices)-from, func(i int) bool {
+		return r.comparator.Compare(r.indices[from+i].key, key) >= 0
+	})
+	for i := first; i < len(r.indices); i++ {
+		// 同一个key的多个版本按照时间戳从新到旧排列
+		iter := newBlockIterator(r.readBlock(i))
+		for ok := iter.seek(r.comparator, key); ok && iter.key == key; ok = iter.next() {
+			if !visit(iter.data) {
+				return first
+			}
+		}
+		// 只有当前数据块以该key结尾时，更旧的版本才可能在下一个数据块中
+		if r.indices[i].key != key {
+			break
+		}
+	}
+	return first
+}
+
+func (r *segmentReader) close() {
+	if r.segFile != nil {
+		closeFile(r.segFile)
+	}
+}
+
+// 段文件的写入器，把有序的记录按数据块写入段文件，同时为每个数据块生成索引
+type segmentWriter struct {
+	segFile     *os.File
+	indexFile   *os.File
+	compression Compression
+	offset      uint32       // 下一个数据块在段文件中的偏移
+	block       blockBuilder // 当前尚未写入的数据块
+	err         error        // 第一次写入失败的错误，之后的数据都不会再被写入
+}
+
+func newSegmentWriter(segFile, indexFile *os.File, compression Compression) *segmentWriter {
+	return &segmentWriter{segFile: segFile, indexFile: indexFile, compression: compression}
+}
+
+// 添加一条记录，记录必须按照key的顺序添加
+func (w *segmentWriter) add(key string, data Data) {
+	w.block.add(key, data)
+	if w.block.size() >= blockSize {
+		w.flushBlock()
+	}
+}
+
+// 把当前数据块写到段文件中，并在索引文件中记录该数据块的最后一个key以及数据块的偏移
+func (w *segmentWriter) flushBlock() {
+	if len(w.block.buf) == 0 {
+		return
+	}
+	lastKey := w.block.lastKey
+	block := encodeBlock(w.compression, w.block.finish())
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.segFile.Write(block)
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.indexFile.Write(append(addBufHead([]byte(lastKey)), uint32ToBytes(w.offset)...))
+	w.offset += uint32(len(block))
+}
+
+// 写入剩余的数据，返回写入过程中的第一个错误
+func (w *segmentWriter) finish() error {
+	w.flushBlock()
+	return w.err
+}
+
+// 段文件的迭代器，按顺序读取段文件中的所有记录
+type segmentIterator struct {
+	file   *os.File
+	size   int64
+	offset uint32         // 下一个数据块在段文件中的偏移
+	block  *blockIterator // 当前数据块的迭代器
+	key    string
+	data   Data
+}
+
+func newSegmentIterator(file *os.File) *segmentIterator {
+	return &segmentIterator{file: file, size: getFileSize(file)}
+}
+
+// 读取下一条记录，没有更多的记录时返回false
+func (it *segmentIterator) next() bool {
+	for it.block == nil || !it.block.next() {
+		if int64(it.offset) >= it.size {
+			return false
+		}
+		block, length := readBlock(it.file, it.offset)
+		it.block = newBlockIterator(block)
+		it.offset += length
+	}
+	it.key = it.block.key
+	it.data = it.block.data
+	return true
+}
+
+// 统计一组段文件的压缩信息
+func getCompressionStats(indexFilesPath []string) CompressionStats {
+	var stats CompressionStats
+	for _, indexFilePath := range indexFilesPath {
+		segFile, err := os.Open(strings.Replace(indexFilePath, indexFileSuffix, segmentFileSuffix, -1))
+		if os.IsNotExist(err) {
+			// 调用者没有持有锁，段文件可能已经在合并之后被删除
+			continue
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		size := getFileSize(segFile)
+		for offset := uint32(0); int64(offset) < size; {
+			_, rawLength, length := readBlockHeader(segFile, offset)
+			stats.Blocks += 1
+			stats.RawBytes += uint64(rawLength)
+			stats.CompressedBytes += uint64(blockHeaderSize + length)
+			offset += blockHeaderSize + length
+		}
+		closeFile(segFile)
+	}
+	return stats
+}
@@ -0,0 +1,220 @@
+package lsm
+
+import (
+	"container/list"
+	"sync"
+)
+
+const defaultBlockCacheSize = 1024 * 1024 * 8 // 默认的数据块缓存大小
+
+// 进程内默认共享的数据块缓存，没有指定缓存的Lsm和Reader都会使用它
+var defaultBlockCache = NewBlockCache(defaultBlockCacheSize)
+
+// 缓存的统计信息
+type CacheStats struct {
+	Hits     uint64 // 命中次数
+	Misses   uint64 // 未命中次数
+	Entries  int    // 当前缓存的条目数
+	Size     int64  // 当前占用的字节数
+	Capacity int64  // 最大可以占用的字节数
+}
+
+// 命中率
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type lruEntry struct {
+	key   interface{}
+	value interface{}
+	size  int64
+}
+
+// 基于LRU淘汰策略的缓存，超出容量时淘汰最久没有被使用的条目
+type lruCache struct {
+	mutex    sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List // 越靠前的条目越是最近被使用的
+	items    map[interface{}]*list.Element
+	hits     uint64
+	misses   uint64
+}
+
+func newLruCache(capacity int64) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		lru:      list.New(),
+		items:    make(map[interface{}]*list.Element),
+	}
+}
+
+// 获取缓存的条目
+func (c *lruCache) get(key interface{}) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.items[key]
+	if !ok {
+		c.misses += 1
+		return nil, false
+	}
+	c.hits += 1
+	c.lru.MoveToFront(element)
+	return element.Value.(*lruEntry).value, true
+}
+
+// 缓存一个条目，size为该条目占用的字节数
+func (c *lruCache) set(key interface{}, value interface{}, size int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.setLocked(key, value, size)
+}
+
+func (c *lruCache) setLocked(key interface{}, value interface{}, size int64) {
+	if element, ok := c.items[key]; ok {
+		c.removeElement(element)
+	}
+	if size > c.capacity {
+		return
+	}
+	c.items[key] = c.lru.PushFront(&lruEntry{key: key, value: value, size: size})
+	c.size += size
+	for c.size > c.capacity {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// 移除所有满足条件的条目
+func (c *lruCache) removeIf(match func(key interface{}) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+		if match(element.Value.(*lruEntry).key) {
+			c.removeElement(element)
+		}
+		element = next
+	}
+}
+
+func (c *lruCache) removeElement(element *list.Element) {
+	entry := c.lru.Remove(element).(*lruEntry)
+	delete(c.items, entry.key)
+	c.size -= entry.size
+}
+
+// 获取缓存的统计信息
+func (c *lruCache) stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return CacheStats{
+		Hits:     c.hits,
+		Misses:   c.misses,
+		Entries:  c.lru.Len(),
+		Size:     c.size,
+		Capacity: c.capacity,
+	}
+}
+
+// 数据块缓存的key，段文件的名称不会被重复使用，因此可以用段文件路径和偏移唯一确定一个数据块
+type blockCacheKey struct {
+	segment string // 段文件的路径
+	offset  uint32 // 数据块在段文件中的偏移
+}
+
+// 缓存解压后的数据块，可以被同一进程中的多个Lsm和Reader共享
+type BlockCache struct {
+	cache *lruCache
+}
+
+// 新建一个数据块缓存，capacity为缓存最多占用的字节数，为0时不进行缓存
+func NewBlockCache(capacity int64) *BlockCache {
+	return &BlockCache{cache: newLruCache(capacity)}
+}
+
+// 获取缓存的数据块
+func (c *BlockCache) get(segment string, offset uint32) ([]byte, bool) {
+	block, ok := c.cache.get(blockCacheKey{segment, offset})
+	if !ok {
+		return nil, false
+	}
+	return block.([]byte), true
+}
+
+// 缓存数据块
+func (c *BlockCache) set(segment string, offset uint32, block []byte) {
+	c.cache.set(blockCacheKey{segment, offset}, block, int64(len(block)))
+}
+
+// 移除指定段文件的所有数据块，在段文件被删除时调用
+func (c *BlockCache) evictSegment(segment string) {
+	c.cache.removeIf(func(key interface{}) bool {
+		return key.(blockCacheKey).segment == segment
+	})
+}
+
+// 获取缓存的统计信息
+func (c *BlockCache) Stats() CacheStats {
+	return c.cache.stats()
+}
+
+// 行缓存中保存的查询结果
+type rowCacheEntry struct {
+	data  Data // 段文件中key的最新记录，可能是删除标记
+	found bool // 为false表示段文件中不存在该key
+}
+
+// 缓存key在段文件中的查询结果，位于段文件查询之前
+type rowCache struct {
+	*lruCache
+	version uint64 // 每次失效操作都会增加版本号，用于丢弃查询期间已经失效的结果
+}
+
+func newRowCache(capacity int64) *rowCache {
+	return &rowCache{lruCache: newLruCache(capacity)}
+}
+
+// 获取缓存的查询结果，同时返回当前的版本号
+func (c *rowCache) lookup(key string) (rowCacheEntry, bool, uint64) {
+	c.mutex.Lock()
+	version := c.version
+	c.mutex.Unlock()
+	entry, ok := c.get(key)
+	if !ok {
+		return rowCacheEntry{}, false, version
+	}
+	return entry.(rowCacheEntry), true, version
+}
+
+// 缓存查询结果，如果在查询期间发生过失效操作则丢弃该结果
+func (c *rowCache) fill(key string, entry rowCacheEntry, version uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.version != version {
+		return
+	}
+	c.setLocked(key, entry, int64(len(key)+len(entry.data.value)))
+}
+
+// 使指定key的缓存失效
+func (c *rowCache) invalidate(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.version += 1
+	if element, ok := c.items[key]; ok {
+		c.removeElement(element)
+	}
+}
+
+// 使所有缓存失效
+func (c *rowCache) invalidateAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.version += 1
+	for element := c.lru.Front(); element != nil; element = c.lru.Front() {
+		c.removeElement(element)
+	}
+}
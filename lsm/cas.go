@@ -0,0 +1,55 @@
+package lsm
+
+import (
+	"math"
+	"time"
+)
+
+// 在写锁的保护下读取key当前的值，LSM已经关闭时返回ErrClosed
+func (cf *ColumnFamily) current(key string) (string, bool, error) {
+	if cf.lsm.closed {
+		return "", false, ErrClosed
+	}
+	return cf.view().get(key, math.MaxUint64, uint64(time.Now().UnixNano()))
+}
+
+// 如果key当前的值等于expected则把它修改为value，返回是否修改成功，LSM已经关闭时返回ErrClosed
+func (cf *ColumnFamily) CompareAndSet(key string, expected string, value string) (bool, error) {
+	cf.lsm.mutex.Lock()
+	defer cf.lsm.mutex.Unlock()
+	current, ok, err := cf.current(key)
+	if err != nil || !ok || current != expected {
+		return false, err
+	}
+	return cf.writeLocked(key, Data{value: value, kind: typeValue})
+}
+
+// 如果key当前不存在则保存value，返回是否保存成功，LSM已经关闭时返回ErrClosed
+func (cf *ColumnFamily) SetIfAbsent(key string, value string) (bool, error) {
+	cf.lsm.mutex.Lock()
+	defer cf.lsm.mutex.Unlock()
+	_, ok, err := cf.current(key)
+	if err != nil || ok {
+		return false, err
+	}
+	return cf.writeLocked(key, Data{value: value, kind: typeValue})
+}
+
+// 如果key当前的值等于expected则删除它，返回是否删除成功，LSM已经关闭时返回ErrClosed
+func (cf *ColumnFamily) DeleteIfEquals(key string, expected string) (bool, error) {
+	cf.lsm.mutex.Lock()
+	defer cf.lsm.mutex.Unlock()
+	current, ok, err := cf.current(key)
+	if err != nil || !ok || current != expected {
+		return false, err
+	}
+	return cf.writeLocked(key, Data{kind: typeDeletion})
+}
+
+// 在写锁的保护下写入一条记录
+func (cf *ColumnFamily) writeLocked(key string, data Data) (bool, error) {
+	if err := cf.lsm.writeRecords([]record{{key, data, cf.name}}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,188 @@
+package lsm
+
+import (
+	"errors"
+	"github.com/ryszard/goskiplist/skiplist"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const defaultColumnFamily = "default" // 默认列族的名称
+
+// 列族名称只能由字母、数字、下划线和中划线组成，它同时也是列族数据目录的名称
+var columnFamilyNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// LSM目录中的数据文件使用的名称不能作为列族的名称
+var reservedColumnFamilyNames = map[string]bool{transLog: true, metadataFile: true, manifestFile: true, writeLockFile: true}
+
+var (
+	ErrInvalidColumnFamily = errors.New("invalid column family name")
+	ErrUnknownColumnFamily = errors.New("column family is not opened by this lsm")
+)
+
+// 列族，同一个LSM目录中的一个独立的key空间。
+// 列族拥有自己的memTable、段文件以及合并相关的配置，所有列族共享同一个transLog和写锁，
+// 非默认列族的段文件保存在LSM目录中以列族名称命名的子目录里，可以直接使用Reader读取该子目录
+type ColumnFamily struct {
+	lsm              *Lsm
+	name             string
+	path             string // 列族段文件所在的目录
+	memTable         *skiplist.SkipList
+	manifestMutex    sync.Mutex
+	compactionMutex  sync.Mutex        // 保证同一时刻只有一个合并操作，后台合并和手动合并都需要持有
+	obsolete         []obsoleteSegment // 已经被合并但是还没有被删除的段文件
+	comparator       Comparator        // key的比较器
+	compression      Compression       // 段文件数据块使用的压缩算法
+	rowCache         *rowCache         // 行缓存，缓存key在段文件中的查询结果
+	maxVersions      int               // 多版本模式下每个key最多保留的版本数
+	versionRetention time.Duration     // 多版本模式下旧版本的保留时长
+	mergeOperator    MergeOperator     // 合并操作符
+	segmentReads     *Histogram        // 每次Get查找的段文件数量
+	mergeDuration    *Histogram        // 合并的耗时
+	mergeBytes       *Counter          // 合并生成的段文件的总大小
+}
+
+// 使用配置项中和列族相关的部分创建一个列族，配置的比较器需要和目录中已经保存的比较器一致
+func newColumnFamily(lsm *Lsm, name string, director string, options Options) (*ColumnFamily, error) {
+	migrated, err := openFormat(director)
+	if err != nil {
+		return nil, err
+	}
+	if migrated > 0 {
+		lsm.logger.Info("legacy segments migrated", "director", director, "segments", migrated)
+	}
+	comparator, err := openComparator(director, options.Comparator, true)
+	if err != nil {
+		return nil, err
+	}
+	cf := &ColumnFamily{
+		lsm:              lsm,
+		name:             name,
+		path:             director,
+		memTable:         newMemTable(comparator),
+		comparator:       comparator,
+		compression:      options.Compression,
+		rowCache:         newRowCache(options.RowCacheSize),
+		maxVersions:      options.MaxVersions,
+		versionRetention: options.VersionRetention,
+		mergeOperator:    options.MergeOperator,
+	}
+	cf.registerMetrics()
+	// 带有不可用标志的段文件要么已经被合并但是在删除之前LSM就被关闭了，要么是没有完成的合并或者同步生成的，
+	// 打开时没有正在进行的合并，因此它们都可以被删除
+	// 它们可能是在上一次关闭之前刚刚被合并的，其他进程中的Reader仍然可能在读取，因此同样需要等待一段时间再删除
+	cf.markObsolete(getUnavailableSegmentFilesPath(director))
+	// 在同步memTable时崩溃或者索引文件被删除的段文件没有索引，读取时无法找到它们，需要重新生成索引
+	rebuilt := false
+	for _, segFilePath := range getUnindexedSegmentFilesPath(director) {
+		if err := RebuildIndex(segFilePath); err != nil {
+			lsm.logger.Warn("index not rebuilt", "segment", segFilePath, "error", err)
+			continue
+		}
+		lsm.logger.Info("index rebuilt", "segment", segFilePath)
+		rebuilt = true
+	}
+	if _, _, ok := readManifest(director); !ok || len(cf.obsolete) > 0 || rebuilt {
+		cf.updateManifest()
+	}
+	return cf, nil
+}
+
+// 列族的名称
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// 打开一个列族，列族不存在时创建它，只有和列族相关的配置项会生效，同一个列族只会被打开一次
+func (l *Lsm) OpenColumnFamily(name string, options Options) (*ColumnFamily, error) {
+	if !columnFamilyNamePattern.MatchString(name) || reservedColumnFamilyNames[name] {
+		return nil, ErrInvalidColumnFamily
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
+	if cf, ok := l.families[name]; ok {
+		return cf, nil
+	}
+	director := path.Join(l.path, name)
+	err := os.MkdirAll(director, 0755)
+	if err != nil {
+		return nil, err
+	}
+	cf, err := newColumnFamily(l, name, director, options)
+	if err != nil {
+		return nil, err
+	}
+	// 恢复打开LSM时转存到列族目录中的transLog数据
+	transLogFilePath := path.Join(director, transLog)
+	if _, err := os.Stat(transLogFilePath); !os.IsNotExist(err) {
+		entries, err := readTransLog(transLogFilePath, l.logger)
+		if err != nil {
+			return nil, err
+		}
+		cf.restore(entries)
+		removeFile(transLogFilePath)
+	}
+	l.families[name] = cf
+	l.background.Add(1)
+	go cf.backgroundMerge()
+	return cf, nil
+}
+
+// 一组可以跨越多个列族的写入，通过Lsm.Write原子地写入
+type Batch struct {
+	records  []record
+	families []*ColumnFamily // 每条记录所属的列族
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+func (b *Batch) add(cf *ColumnFamily, key string, data Data) {
+	b.records = append(b.records, record{key, data, cf.name})
+	b.families = append(b.families, cf)
+}
+
+// 在列族中保存一组key,value
+func (b *Batch) Set(cf *ColumnFamily, key string, value string) {
+	b.add(cf, key, Data{value: value, kind: typeValue})
+}
+
+// 在列族中删除一个key
+func (b *Batch) Delete(cf *ColumnFamily, key string) {
+	b.add(cf, key, Data{kind: typeDeletion})
+}
+
+// 在列族中记录一个合并操作数
+func (b *Batch) Merge(cf *ColumnFamily, key string, operand string) {
+	b.add(cf, key, Data{value: operand, kind: typeMerge})
+}
+
+// 原子地写入一组记录，所有记录作为transLog中的一个条目写入并且使用同一个时间戳，
+// 记录所属的列族不是由这个LSM打开的时候返回ErrUnknownColumnFamily
+func (l *Lsm) Write(batch *Batch) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for i, r := range batch.records {
+		// 列族必须是由这个LSM打开的
+		cf, ok := l.families[r.family]
+		if !ok || cf != batch.families[i] {
+			return ErrUnknownColumnFamily
+		}
+		if r.data.kind == typeMerge && cf.mergeOperator == nil {
+			return ErrNoMergeOperator
+		}
+	}
+	if len(batch.records) == 0 {
+		return nil
+	}
+	records := make([]record, len(batch.records))
+	copy(records, batch.records)
+	return l.writeRecords(records)
+}
@@ -0,0 +1,149 @@
+package lsm
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// 手动合并列族中key的范围和[start, end)有交集的所有段文件，start为空表示没有下界，end为空表示没有上界。
+// 合并会清理不再被需要的旧版本以及过期的数据，参与合并的段文件包含了key的所有版本时删除标记也会被清理，
+// memTable中的数据不会参与合并
+func (cf *ColumnFamily) CompactRange(start string, end string) error {
+	return cf.CompactRangeContext(context.Background(), start, end)
+}
+
+// 和CompactRange相同，每写入一条记录之前都会检查ctx，ctx被取消时放弃合并并删除已经写入的部分，返回ctx.Err()。
+// LSM在合并的过程中被关闭时同样会放弃合并，此时返回ErrClosed
+func (cf *ColumnFamily) CompactRangeContext(ctx context.Context, start string, end string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// 手动合并和后台协程一样需要在LSM关闭之前结束
+	cf.lsm.mutex.RLock()
+	if cf.lsm.closed {
+		cf.lsm.mutex.RUnlock()
+		return ErrClosed
+	}
+	cf.lsm.background.Add(1)
+	cf.lsm.mutex.RUnlock()
+	defer cf.lsm.background.Done()
+
+	cf.compactionMutex.Lock()
+	defer cf.compactionMutex.Unlock()
+	segments := make([]string, 0)
+	for _, indexFilePath := range getAvailableIndexFilesPath(cf.path) {
+		smallest, largest, ok := segmentKeyRange(cf.lsm.blockCache, cf.comparator, indexFilePath)
+		if !ok {
+			continue
+		}
+		if (end == "" || cf.comparator.Compare(smallest, end) < 0) && (start == "" || cf.comparator.Compare(largest, start) >= 0) {
+			segments = append(segments, strings.Replace(indexFilePath, indexFileSuffix, segmentFileSuffix, -1))
+		}
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+	return cf.compactSegments(ctx, segments)
+}
+
+// 把多个段文件合并为一个新的段文件，旧的段文件被打上不可用标志，等待一段时间之后再删除，调用者需要持有合并锁
+func (cf *ColumnFamily) compactSegments(ctx context.Context, segments []string) error {
+	start := time.Now()
+	info := CompactionInfo{Family: cf.name, Manual: true, Inputs: segments, InputBytes: getFilesBytes(segments)}
+	cf.lsm.listener.OnCompactionBegin(info)
+	segFile := createNewSegFile(cf.path)
+	indexFile, err := os.Create(strings.Replace(segFile.Name(), segmentFileSuffix, indexFileSuffix, -1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	sources := make([]recordIterator, 0, len(segments))
+	files := make([]*os.File, 0, len(segments))
+	for _, segFilePath := range segments {
+		file, err := os.Open(segFilePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		files = append(files, file)
+		sources = append(sources, newSegmentIterator(file))
+	}
+	iter := newMergingIterator(cf.comparator, sources)
+	compactor := newCompactor(cf.newCompactionFilter(segments), newSegmentWriter(segFile, indexFile, cf.compression))
+	for err == nil && iter.next() {
+		if err = cf.lsm.interrupted(ctx); err == nil {
+			compactor.add(iter.key, iter.data)
+		}
+	}
+	if err == nil {
+		err = compactor.finish()
+	}
+	for _, file := range files {
+		closeFile(file)
+	}
+	closeFile(segFile)
+	closeFile(indexFile)
+	if err != nil {
+		// 删除没有写完的段文件，它带有不可用标志，因此不会被读取到
+		removeFile(indexFile.Name())
+		removeFile(segFile.Name())
+		removeFile(strings.Replace(segFile.Name(), segmentFileSuffix, unavailableFileSuffix, -1))
+		cf.lsm.logger.Warn("compaction aborted", "family", cf.name, "inputs", segments, "error", err)
+		info.Duration, info.Err = time.Since(start), err
+		cf.lsm.listener.OnCompactionEnd(info)
+		return err
+	}
+
+	// 先让新的段文件可用，再给旧的段文件打上不可用标志
+	removeFile(strings.Replace(segFile.Name(), segmentFileSuffix, unavailableFileSuffix, -1))
+	for _, segFilePath := range segments {
+		uaFile, err := os.Create(strings.Replace(segFilePath, segmentFileSuffix, unavailableFileSuffix, -1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		closeFile(uaFile)
+	}
+	cf.updateManifest()
+	cf.observeMerge(start, segFile.Name())
+	info.Output, info.OutputBytes = segFile.Name(), getFilesBytes([]string{segFile.Name()})
+	info.Duration = time.Since(start)
+	cf.lsm.listener.OnCompactionEnd(info)
+	// 读取在整个过程中都持有读锁，获取到写锁之后就不会再有读取在使用旧的段文件
+	cf.lsm.mutex.Lock()
+	cf.rowCache.invalidateAll()
+	cf.lsm.mutex.Unlock()
+	// 旧的段文件在等待一段时间之后由后台合并删除
+	cf.markObsolete(segments)
+	cf.lsm.logger.Info("segments compacted", "family", cf.name, "inputs", segments, "output", segFile.Name(),
+		"duration", time.Since(start))
+	return nil
+}
+
+// ctx被取消时返回ctx.Err()，LSM已经关闭时返回ErrClosed
+func (l *Lsm) interrupted(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-l.done:
+		return ErrClosed
+	default:
+		return nil
+	}
+}
+
+// 获取段文件中最小和最大的key，段文件为空时返回false
+func segmentKeyRange(cache *BlockCache, comparator Comparator, indexFilePath string) (string, string, bool) {
+	reader := newSegmentReader(cache, comparator, indexFilePath)
+	defer reader.close()
+	if len(reader.indices) == 0 {
+		return "", "", false
+	}
+	// 索引中记录的是每个数据块的最后一个key，最小的key是第一个数据块的第一条记录
+	iter := newBlockIterator(reader.readBlock(0))
+	if !iter.next() {
+		return "", "", false
+	}
+	return iter.key, reader.indices[len(reader.indices)-1].key, true
+}
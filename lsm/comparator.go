@@ -0,0 +1,108 @@
+package lsm
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// 比较器，决定key的排列顺序，memTable、索引查找、迭代器以及段文件合并都使用同一个比较器
+type Comparator interface {
+	// 比较器的名称，它会被保存在元数据中，之后打开同一份数据时必须使用同名的比较器
+	Name() string
+	// a小于b时返回负数，相等时返回0，大于时返回正数，只有完全相同的两个key才能相等
+	Compare(a, b string) int
+}
+
+// 按照字节序比较key，这是默认的比较器
+var BytewiseComparator Comparator = bytewiseComparator{}
+
+// 按照字节序的逆序比较key
+var ReverseBytewiseComparator Comparator = reverseBytewiseComparator{}
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Name() string {
+	return "lsm.BytewiseComparator"
+}
+
+func (bytewiseComparator) Compare(a, b string) int {
+	return strings.Compare(a, b)
+}
+
+type reverseBytewiseComparator struct{}
+
+func (reverseBytewiseComparator) Name() string {
+	return "lsm.ReverseBytewiseComparator"
+}
+
+func (reverseBytewiseComparator) Compare(a, b string) int {
+	return strings.Compare(b, a)
+}
+
+var ErrComparatorMismatch = errors.New("comparator does not match the one persisted in metadata")
+
+const comparatorMetadataKey = "comparator" // 元数据中保存比较器名称的key
+
+// 读取目录中的元数据，每一行是一组key=value
+func readMetadata(director string) map[string]string {
+	metadata := make(map[string]string)
+	content, err := ioutil.ReadFile(path.Join(director, metadataFile))
+	if os.IsNotExist(err) {
+		return metadata
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if i := strings.Index(line, "="); i > 0 {
+			metadata[line[:i]] = line[i+1:]
+		}
+	}
+	return metadata
+}
+
+// 把元数据写入目录，先写临时文件再重命名，保证元数据文件总是完整的
+func writeMetadata(director string, metadata map[string]string) {
+	content := ""
+	for key, value := range metadata {
+		content += key + "=" + value + "\n"
+	}
+	tmpFilePath := path.Join(director, metadataFile+".tmp")
+	err := ioutil.WriteFile(tmpFilePath, []byte(content), 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.Rename(tmpFilePath, path.Join(director, metadataFile))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// 确定目录中的数据使用的比较器。没有指定比较器时使用元数据中保存的内置比较器，
+// 指定的比较器和元数据中保存的不一致时返回错误；persist为true时会把比较器的名称保存到元数据中
+func openComparator(director string, comparator Comparator, persist bool) (Comparator, error) {
+	metadata := readMetadata(director)
+	name, ok := metadata[comparatorMetadataKey]
+	if !ok && len(getIndexFilesPath(director)) > 0 {
+		// 在比较器被引入之前写入的数据都是按照字节序排列的
+		name, ok = BytewiseComparator.Name(), true
+	}
+	if comparator == nil {
+		comparator = BytewiseComparator
+		if ok && name == ReverseBytewiseComparator.Name() {
+			comparator = ReverseBytewiseComparator
+		}
+	}
+	if ok && name != comparator.Name() {
+		return nil, ErrComparatorMismatch
+	}
+	if persist && metadata[comparatorMetadataKey] != comparator.Name() {
+		metadata[comparatorMetadataKey] = comparator.Name()
+		writeMetadata(director, metadata)
+	}
+	return comparator, nil
+}
@@ -0,0 +1,100 @@
+package lsm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// 段文件或者transLog中的一条原始记录，用于检查数据文件
+type Record struct {
+	Family    string // 记录所属的列族，只有transLog中的记录有该字段
+	Key       string
+	Value     string
+	Timestamp uint64
+	Kind      string        // 记录的类型：value、deletion或者merge
+	TTL       time.Duration // 存活时长，为0表示永不过期
+}
+
+func newRecord(family string, key string, data Data) Record {
+	kind := "unknown"
+	switch data.kind {
+	case typeValue:
+		kind = "value"
+	case typeDeletion:
+		kind = "deletion"
+	case typeMerge:
+		kind = "merge"
+	}
+	return Record{Family: family, Key: key, Value: data.value, Timestamp: data.timestamp, Kind: kind, TTL: time.Duration(data.ttl)}
+}
+
+// 以该key结尾的数据块的最后一个key
+func (i Index) Key() string {
+	return i.key
+}
+
+// 数据块在段文件中的偏移
+func (i Index) Offset() uint32 {
+	return i.offset
+}
+
+// 按顺序访问段文件中的所有记录，offset是记录所在数据块在段文件中的偏移，visit返回false时停止。
+// 数据块损坏时返回ErrCorruptSegment，损坏之前的记录已经被访问过
+func ReadSegment(segFilePath string, visit func(offset uint32, r Record) bool) error {
+	segFile, err := os.Open(segFilePath)
+	if err != nil {
+		return err
+	}
+	defer segFile.Close()
+	size := getFileSize(segFile)
+	for offset := uint32(0); int64(offset) < size; {
+		raw, length, err := readBlockChecked(segFile, offset, size)
+		if err != nil {
+			return fmt.Errorf("%w: %s: block at offset %d: %v", ErrCorruptSegment, segFilePath, offset, err)
+		}
+		entries, err := decodeBlock(raw)
+		if err != nil {
+			return fmt.Errorf("%w: %s: block at offset %d: %v", ErrCorruptSegment, segFilePath, offset, err)
+		}
+		for _, entry := range entries {
+			if !visit(offset, newRecord("", entry.key, entry.data)) {
+				return nil
+			}
+		}
+		offset += length
+	}
+	return nil
+}
+
+// 读取索引文件中的所有索引，索引文件的格式错误时返回错误
+func ReadIndex(indexFilePath string) ([]Index, error) {
+	indexData, err := ioutil.ReadFile(indexFilePath)
+	if err != nil {
+		return nil, err
+	}
+	indices, err := parseIndex(indexData)
+	if err != nil {
+		return nil, fmt.Errorf("%s: corrupt index: %v", indexFilePath, err)
+	}
+	return indices, nil
+}
+
+// 按顺序访问transLog中所有完整的记录，entry是记录所在条目的序号，同一个条目中的记录是原子写入的，visit返回false时停止。
+// 返回末尾不完整的条目的字节数，进程崩溃或者正在写入时最后一个条目可能不完整；中间的条目损坏时返回ErrCorruptTransLog
+func ReadTransLog(transLogFilePath string, visit func(entry int, r Record) bool) (int, error) {
+	logData, err := ioutil.ReadFile(transLogFilePath)
+	if err != nil {
+		return 0, err
+	}
+	entries, valid, decodeErr := decodeTransLog(logData)
+	for entry, records := range entries {
+		for _, r := range records {
+			if !visit(entry, newRecord(r.family, r.key, r.data)) {
+				return 0, nil
+			}
+		}
+	}
+	return len(logData) - valid, decodeErr
+}
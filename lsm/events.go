@@ -0,0 +1,87 @@
+package lsm
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// 事件监听器，所有回调都在执行对应操作的协程中被同步调用，回调返回之后操作才会继续，因此回调应该尽快返回。
+// 同步memTable时LSM持有写锁，合并时持有列族的合并锁，回调中不能再调用LSM的任何方法，否则可能发生死锁。
+//
+// 同一个列族的事件按照以下顺序发生：
+//   - OnFlushBegin在写入段文件之前调用，OnFlushEnd在段文件写入清单之后调用，此时段文件已经可以被读取；
+//     所有列族的OnFlushEnd都在OnWALRotated之前调用，transLog被清空时其中的数据都已经保存在段文件中
+//   - OnCompactionBegin在写入新的段文件之前调用，OnCompactionEnd在新的段文件写入清单、旧的段文件被标记为不可用之后调用
+//   - 旧的段文件在OnCompactionEnd之后由后台合并在等待一段时间之后删除，每删除一个段文件调用一次OnTableDeleted，
+//     被Reader固定的段文件会在之后的某次合并中才被删除，LSM关闭时还没有删除的段文件会在下一次打开之后被删除
+//   - 同步或者合并被取消时同样会调用对应的End回调，此时info.Err不为空，并且没有生成新的段文件
+type EventListener interface {
+	OnFlushBegin(info FlushInfo)
+	OnFlushEnd(info FlushInfo)
+	OnCompactionBegin(info CompactionInfo)
+	OnCompactionEnd(info CompactionInfo)
+	OnTableDeleted(info TableDeletedInfo)
+	OnWALRotated(info WALRotatedInfo)
+	// 后台协程遇到错误时调用。transLog同步失败是无法恢复的，回调返回之后进程会退出；
+	// 后台合并或者删除废弃的段文件失败时原有的段文件保持不变，下一次检查时会再次尝试
+	OnBackgroundError(err error)
+}
+
+// 不处理任何事件的监听器，嵌入到自定义的监听器中之后只需要实现关心的回调
+type BaseEventListener struct{}
+
+func (BaseEventListener) OnFlushBegin(info FlushInfo)           {}
+func (BaseEventListener) OnFlushEnd(info FlushInfo)             {}
+func (BaseEventListener) OnCompactionBegin(info CompactionInfo) {}
+func (BaseEventListener) OnCompactionEnd(info CompactionInfo)   {}
+func (BaseEventListener) OnTableDeleted(info TableDeletedInfo)  {}
+func (BaseEventListener) OnWALRotated(info WALRotatedInfo)      {}
+func (BaseEventListener) OnBackgroundError(err error)           {}
+
+// memTable同步到段文件的信息
+type FlushInfo struct {
+	Family   string        // 列族的名称
+	Records  int           // memTable中的记录数
+	Segment  string        // 生成的段文件，只在OnFlushEnd中有效
+	Bytes    int64         // 生成的段文件的大小，只在OnFlushEnd中有效
+	Duration time.Duration // 同步的耗时，只在OnFlushEnd中有效
+	Err      error         // 同步被取消的原因，只在OnFlushEnd中有效
+}
+
+// 段文件合并的信息
+type CompactionInfo struct {
+	Family      string        // 列族的名称
+	Manual      bool          // 是否是通过CompactRange发起的手动合并
+	Inputs      []string      // 被合并的段文件
+	InputBytes  int64         // 被合并的段文件的总大小
+	Output      string        // 生成的段文件，只在OnCompactionEnd中有效
+	OutputBytes int64         // 生成的段文件的大小，只在OnCompactionEnd中有效
+	Duration    time.Duration // 合并的耗时，只在OnCompactionEnd中有效
+	Err         error         // 合并被取消的原因，只在OnCompactionEnd中有效
+}
+
+// 段文件被删除的信息
+type TableDeletedInfo struct {
+	Family  string // 列族的名称
+	Segment string // 被删除的段文件，对应的索引文件也已经被删除
+}
+
+// transLog被清空的信息
+type WALRotatedInfo struct {
+	Path  string // transLog的路径
+	Bytes int64  // 清空之前transLog的大小
+}
+
+// 获取一组文件的总大小
+func getFilesBytes(filesPath []string) int64 {
+	var size int64
+	for _, filePath := range filesPath {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		size += info.Size()
+	}
+	return size
+}
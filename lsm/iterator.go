@@ -0,0 +1,224 @@
+package lsm
+
+import (
+	"context"
+	"github.com/ryszard/goskiplist/skiplist"
+	"math"
+	"os"
+	"time"
+)
+
+// 内部迭代器，按照key升序、同一个key时间戳降序的顺序遍历记录
+type recordIterator interface {
+	next() bool
+	record() (string, Data)
+}
+
+func (it *segmentIterator) record() (string, Data) {
+	return it.key, it.data
+}
+
+// 遍历memTable的迭代器，创建时复制了memTable中的记录，因此不会受到之后写入的影响
+type memTableIterator struct {
+	records []record
+	index   int
+}
+
+func newMemTableIterator(memTable *skiplist.SkipList) *memTableIterator {
+	records := make([]record, 0, memTable.Len())
+	iter := memTable.Iterator()
+	for iter.Next() {
+		records = append(records, record{key: iter.Key().(internalKey).key, data: iter.Value().(Data)})
+	}
+	return &memTableIterator{records: records, index: -1}
+}
+
+func (it *memTableIterator) next() bool {
+	it.index += 1
+	return it.index < len(it.records)
+}
+
+func (it *memTableIterator) record() (string, Data) {
+	return it.records[it.index].key, it.records[it.index].data
+}
+
+// 归并多个内部迭代器，多个来源中相同key和时间戳的记录只会返回一次
+type mergingIterator struct {
+	comparator Comparator
+	sources    []recordIterator
+	valid      []bool // 每个来源当前是否还有记录
+	key        string
+	data       Data
+}
+
+func newMergingIterator(comparator Comparator, sources []recordIterator) *mergingIterator {
+	valid := make([]bool, len(sources))
+	for i, source := range sources {
+		valid[i] = source.next()
+	}
+	return &mergingIterator{comparator: comparator, sources: sources, valid: valid}
+}
+
+func (m *mergingIterator) next() bool {
+	smallest := -1
+	var smallestKey string
+	var smallestData Data
+	for i, source := range m.sources {
+		if !m.valid[i] {
+			continue
+		}
+		key, data := source.record()
+		c := 0
+		if smallest != -1 {
+			c = m.comparator.Compare(key, smallestKey)
+		}
+		if smallest == -1 || c < 0 || (c == 0 && data.timestamp > smallestData.timestamp) {
+			smallest = i
+			smallestKey = key
+			smallestData = data
+		}
+	}
+	if smallest == -1 {
+		return false
+	}
+	m.key = smallestKey
+	m.data = smallestData
+	// 跳过所有来源中的这条记录
+	for i, source := range m.sources {
+		if !m.valid[i] {
+			continue
+		}
+		key, data := source.record()
+		if key == m.key && data.timestamp == m.data.timestamp {
+			m.valid[i] = source.next()
+		}
+	}
+	return true
+}
+
+// 迭代器，按照key的顺序遍历某一时刻的所有数据，使用完毕之后需要调用Close释放打开的段文件
+type Iterator struct {
+	iter      *mergingIterator
+	files     []*os.File // 迭代器打开的段文件
+	timestamp uint64     // 只有时间戳不大于它的记录对迭代器可见，同时也是判断数据是否过期的时间
+	operator  MergeOperator
+	pending   bool // 归并迭代器当前的记录是否还没有被处理
+	started   bool
+	lastKey   string // 上一个处理过的key，它的旧版本都需要被跳过
+	key       string
+	value     string
+	ctx       context.Context // 每读取一条记录之前检查是否已经被取消，为空时不检查
+	err       error
+}
+
+// 创建一个遍历当前所有数据的迭代器
+func (cf *ColumnFamily) NewIterator() *Iterator {
+	return cf.newIterator(math.MaxUint64)
+}
+
+// 创建一个遍历当前所有数据的迭代器，ctx已经被取消时返回ctx.Err()，LSM已经关闭时返回ErrClosed。
+// 迭代器每读取一条记录之前都会检查ctx，ctx被取消之后Next返回false，并且Err返回ctx.Err()
+func (cf *ColumnFamily) NewIteratorContext(ctx context.Context) (*Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	iter := cf.newIterator(math.MaxUint64)
+	if iter.err != nil {
+		return nil, iter.err
+	}
+	iter.ctx = ctx
+	return iter, nil
+}
+
+func (cf *ColumnFamily) newIterator(timestamp uint64) *Iterator {
+	cf.lsm.mutex.RLock()
+	defer cf.lsm.mutex.RUnlock()
+	if timestamp == math.MaxUint64 {
+		// 读取当前的数据，使用当前时间判断数据是否过期
+		timestamp = uint64(time.Now().UnixNano())
+		if timestamp < cf.lsm.lastTimestamp {
+			timestamp = cf.lsm.lastTimestamp
+		}
+	}
+
+	iter := cf.view().newIterator(timestamp)
+	if cf.lsm.closed {
+		iter.err = ErrClosed
+	}
+	return iter
+}
+
+// 移动到下一个key，没有更多的数据时返回false
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	for it.pending || it.iter.next() {
+		if it.ctx != nil && it.ctx.Err() != nil {
+			it.err = it.ctx.Err()
+			return false
+		}
+		it.pending = false
+		key, data := it.iter.key, it.iter.data
+		if data.timestamp > it.timestamp {
+			// 在迭代器创建之后写入的记录不可见
+			continue
+		}
+		if it.started && key == it.lastKey {
+			// 已经处理过该key的最新版本
+			continue
+		}
+		it.started = true
+		it.lastKey = key
+		if data.kind == typeMerge {
+			data, it.err = it.fold(key, data)
+			if it.err != nil {
+				return false
+			}
+		}
+		if !data.exists(it.timestamp) {
+			continue
+		}
+		it.key = key
+		it.value = data.value
+		return true
+	}
+	return false
+}
+
+// 读取key剩余的旧版本，把合并操作数合并到旧值上，读到下一个key时停止
+func (it *Iterator) fold(key string, data Data) (Data, error) {
+	versions := []Data{data}
+	for it.iter.next() {
+		if it.iter.key != key {
+			it.pending = true
+			break
+		}
+		versions = append(versions, it.iter.data)
+	}
+	return foldVersions(it.operator, key, versions, it.timestamp, it.timestamp)
+}
+
+// 当前的key
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// 当前的值
+func (it *Iterator) Value() string {
+	return it.value
+}
+
+// 迭代器因为ctx被取消而提前结束时返回ctx.Err()，迭代器在LSM或者Reader关闭之后创建时返回ErrClosed，遇到合并操作数但是没有配置合并操作符时返回ErrNoMergeOperator，
+// 正常遍历结束时返回nil
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// 关闭迭代器，释放打开的段文件
+func (it *Iterator) Close() {
+	for _, file := range it.files {
+		closeFile(file)
+	}
+	it.files = nil
+}
@@ -0,0 +1,223 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 数据格式的版本保存在元数据中。版本1是最初的格式：段文件由依次排列的记录组成，记录没有类型和存活时长，
+// 目录中也没有元数据文件；版本2的段文件由压缩的数据块组成
+const (
+	formatMetadataKey        = "format"       // 元数据中保存格式版本的key
+	migrateFromMetadataKey   = "migrate_from" // 正在被迁移的旧格式段文件
+	migrateToMetadataKey     = "migrate_to"   // 迁移生成的新格式段文件
+	legacyFormatVersion      = 1
+	currentFormatVersion     = 2
+	legacyRecordTimestampLen = 8
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported data format")
+
+// 读取目录中数据的格式版本，没有元数据文件的目录使用的是最初的格式
+func readFormat(director string, metadata map[string]string) (int, error) {
+	value, ok := metadata[formatMetadataKey]
+	if !ok {
+		if _, err := os.Stat(path.Join(director, metadataFile)); os.IsNotExist(err) {
+			return legacyFormatVersion, nil
+		}
+		// 在格式版本被引入之前已经使用了当前的格式
+		return currentFormatVersion, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || version < legacyFormatVersion || version > currentFormatVersion {
+		return 0, fmt.Errorf("%w: version %s in %s", ErrUnsupportedFormat, value, director)
+	}
+	return version, nil
+}
+
+// 检查Reader能否读取目录中的数据，Reader不会修改数据文件，因此无法读取还没有迁移的旧格式段文件
+func checkFormat(director string) error {
+	metadata := readMetadata(director)
+	version, err := readFormat(director, metadata)
+	if err != nil {
+		return err
+	}
+	_, migrating := metadata[migrateFromMetadataKey]
+	if (version == legacyFormatVersion && len(getIndexFilesPath(director)) > 0) || migrating {
+		return fmt.Errorf("%w: %s uses the legacy format, open it with NewLsm to migrate", ErrUnsupportedFormat, director)
+	}
+	return nil
+}
+
+// 确定目录中数据的格式版本，把旧格式的段文件改写为当前的格式，并在元数据中记录当前的格式版本，返回迁移的段文件数量。
+// 旧格式的段文件全部改写完成之后才会在元数据中一次性地切换格式，迁移过程中崩溃时下一次打开会重新迁移或者完成清理
+func openFormat(director string) (int, error) {
+	metadata := readMetadata(director)
+	version, err := readFormat(director, metadata)
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	if version == legacyFormatVersion {
+		from := make([]string, 0)
+		to := make([]string, 0)
+		// 带有不可用标志的段文件是没有完成的合并或者上一次没有完成的迁移生成的，打开时会被删除
+		for _, indexFilePath := range getAvailableIndexFilesPath(director) {
+			segFilePath := strings.Replace(indexFilePath, indexFileSuffix, segmentFileSuffix, -1)
+			target, err := migrateLegacySegment(segFilePath)
+			if err != nil {
+				return 0, err
+			}
+			from = append(from, path.Base(segFilePath))
+			to = append(to, path.Base(target))
+		}
+		metadata[migrateFromMetadataKey] = strings.Join(from, ",")
+		metadata[migrateToMetadataKey] = strings.Join(to, ",")
+		metadata[formatMetadataKey] = strconv.Itoa(currentFormatVersion)
+		writeMetadata(director, metadata)
+		migrated = len(from)
+	}
+	if _, ok := metadata[migrateFromMetadataKey]; ok {
+		if err := finishMigration(director, metadata); err != nil {
+			return 0, err
+		}
+	}
+	if metadata[formatMetadataKey] != strconv.Itoa(currentFormatVersion) {
+		metadata[formatMetadataKey] = strconv.Itoa(currentFormatVersion)
+		writeMetadata(director, metadata)
+	}
+	return migrated, nil
+}
+
+// 格式切换之后删除旧格式的段文件并让新的段文件可用，重复执行不会产生影响
+func finishMigration(director string, metadata map[string]string) error {
+	for _, name := range strings.Split(metadata[migrateFromMetadataKey], ",") {
+		if name == "" {
+			continue
+		}
+		segFilePath := path.Join(director, name)
+		for _, filePath := range []string{
+			segFilePath,
+			strings.Replace(segFilePath, segmentFileSuffix, indexFileSuffix, -1),
+			strings.Replace(segFilePath, segmentFileSuffix, unavailableFileSuffix, -1),
+		} {
+			if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	for _, name := range strings.Split(metadata[migrateToMetadataKey], ",") {
+		if name == "" {
+			continue
+		}
+		uaFilePath := strings.Replace(path.Join(director, name), segmentFileSuffix, unavailableFileSuffix, -1)
+		if err := os.Remove(uaFilePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	delete(metadata, migrateFromMetadataKey)
+	delete(metadata, migrateToMetadataKey)
+	writeMetadata(director, metadata)
+	return nil
+}
+
+// 把一个旧格式的段文件改写为带有不可用标志的新格式段文件，返回新段文件的路径
+func migrateLegacySegment(segFilePath string) (string, error) {
+	content, err := ioutil.ReadFile(segFilePath)
+	if err != nil {
+		return "", err
+	}
+	entries := make([]segmentEntry, 0)
+	for offset := 0; offset < len(content); {
+		key, data, length, ok := decodeLegacyRecord(content[offset:])
+		if !ok {
+			return "", fmt.Errorf("%w: %s: truncated legacy record at offset %d", ErrCorruptSegment, segFilePath, offset)
+		}
+		entries = append(entries, segmentEntry{key, data})
+		offset += length
+	}
+	// 旧格式的段文件按照字节序排列，同一个key只有一条记录
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key || (entries[i].key == entries[j].key && entries[i].data.timestamp > entries[j].data.timestamp)
+	})
+
+	segFile := createNewSegFile(path.Dir(segFilePath))
+	indexFile, err := os.Create(strings.Replace(segFile.Name(), segmentFileSuffix, indexFileSuffix, -1))
+	if err != nil {
+		closeFile(segFile)
+		return "", err
+	}
+	writer := newSegmentWriter(segFile, indexFile, NoCompression)
+	for _, entry := range entries {
+		writer.add(entry.key, entry.data)
+	}
+	err = writer.finish()
+	closeFile(segFile)
+	closeFile(indexFile)
+	if err != nil {
+		return "", err
+	}
+	return segFile.Name(), nil
+}
+
+// 解码最初格式的transLog，其中的记录都属于默认列族，返回所有完整的记录以及它们的总长度
+func decodeLegacyTransLog(logData []byte) ([][]record, int) {
+	entries := make([][]record, 0)
+	valid := 0
+	for valid < len(logData) {
+		key, data, length, ok := decodeLegacyRecord(logData[valid:])
+		if !ok {
+			break
+		}
+		entries = append(entries, []record{{key, data, defaultColumnFamily}})
+		valid += length
+	}
+	return entries, valid
+}
+
+// 解码一条旧格式的记录：key + value + 时间戳(8)，数据不完整时返回false
+func decodeLegacyRecord(buf []byte) (string, Data, int, bool) {
+	key, keyLength, ok := decodeLegacyBuf(buf)
+	if !ok {
+		return "", Data{}, 0, false
+	}
+	value, valueLength, ok := decodeLegacyBuf(buf[keyLength:])
+	if !ok {
+		return "", Data{}, 0, false
+	}
+	offset := keyLength + valueLength
+	if len(buf) < offset+legacyRecordTimestampLen {
+		return "", Data{}, 0, false
+	}
+	timestamp := binary.LittleEndian.Uint64(buf[offset:])
+	return string(key), Data{value: string(value), timestamp: timestamp, kind: typeValue}, offset + legacyRecordTimestampLen, true
+}
+
+// 带有边界检查的parseBuf
+func decodeLegacyBuf(buf []byte) ([]byte, int, bool) {
+	if len(buf) < 1 {
+		return nil, 0, false
+	}
+	if buf[0] < 0xff {
+		length := int(buf[0])
+		if len(buf) < 1+length {
+			return nil, 0, false
+		}
+		return buf[1 : 1+length], 1 + length, true
+	}
+	if len(buf) < 5 {
+		return nil, 0, false
+	}
+	length := uint64(binary.LittleEndian.Uint32(buf[1:]))
+	if uint64(len(buf)) < 5+length {
+		return nil, 0, false
+	}
+	return buf[5 : 5+length], 5 + int(length), true
+}
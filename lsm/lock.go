@@ -0,0 +1,71 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrLocked = errors.New("director has been used for another LSM Tree")
+
+// 获取目录的写锁，并在锁文件中记录持有者的进程号、主机名以及加锁时间用于排查问题
+func lockDirector(director string) (*os.File, error) {
+	lockFilePath := path.Join(director, writeLockFile)
+	lockFile, ok := tryLockFile(lockFilePath)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is locked by %s", ErrLocked, director, lockHolder(lockFilePath))
+	}
+	hostname, _ := os.Hostname()
+	holder := "pid=" + strconv.Itoa(os.Getpid()) + "\n" +
+		"hostname=" + hostname + "\n" +
+		"time=" + time.Now().Format(time.RFC3339) + "\n"
+	err := lockFile.Truncate(0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = lockFile.WriteAt([]byte(holder), 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return lockFile, nil
+}
+
+// 释放目录的写锁，需要先删除锁文件再关闭它，否则其他进程可能会锁住一个已经被删除的锁文件
+func unlockDirector(lockFile *os.File) {
+	removeFile(lockFile.Name())
+	closeFile(lockFile)
+}
+
+// 锁文件中记录的持有者信息
+func lockHolder(lockFilePath string) string {
+	content, err := ioutil.ReadFile(lockFilePath)
+	if err != nil || len(content) == 0 {
+		return "unknown holder"
+	}
+	return strings.Replace(strings.TrimSpace(string(content)), "\n", ", ", -1)
+}
+
+// 清除目录中残留的锁文件。
+// 没有进程持有锁时直接删除锁文件；锁由操作系统管理时，持有锁的进程一定还存活，此时返回ErrLocked；
+// 在不支持文件锁的平台上锁文件本身就是锁，调用者需要自己确认持有锁的进程已经退出
+func ForceUnlock(director string) error {
+	lockFilePath := path.Join(director, writeLockFile)
+	if _, err := os.Stat(lockFilePath); os.IsNotExist(err) {
+		return nil
+	}
+	if lockFile, ok := tryLockFile(lockFilePath); ok {
+		unlockDirector(lockFile)
+		return nil
+	}
+	if lockReleasedOnExit {
+		return fmt.Errorf("%w: %s is locked by live process %s", ErrLocked, director, lockHolder(lockFilePath))
+	}
+	removeFile(lockFilePath)
+	return nil
+}
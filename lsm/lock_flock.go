@@ -0,0 +1,45 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package lsm
+
+import (
+	"errors"
+	"log"
+	"os"
+	"syscall"
+)
+
+// 使用flock加锁，进程退出时操作系统会自动释放锁，崩溃之后残留的锁文件不会阻止再次打开目录
+const lockReleasedOnExit = true
+
+// 尝试对锁文件加排他锁，锁已经被其他进程持有时返回false
+func tryLockFile(lockFilePath string) (*os.File, bool) {
+	for {
+		lockFile, err := os.OpenFile(lockFilePath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			closeFile(lockFile)
+			return nil, false
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		// 加锁之前锁文件可能已经被上一个持有者删除，此时锁住的是一个已经不在目录中的文件，需要重新加锁
+		info, err := lockFile.Stat()
+		if err != nil {
+			log.Fatal(err)
+		}
+		current, err := os.Stat(lockFilePath)
+		if err == nil && os.SameFile(info, current) {
+			return lockFile, true
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		closeFile(lockFile)
+	}
+}
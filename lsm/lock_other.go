@@ -0,0 +1,24 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package lsm
+
+import (
+	"log"
+	"os"
+)
+
+// 不支持flock的平台使用锁文件是否存在作为锁，进程崩溃之后需要通过ForceUnlock清除残留的锁文件
+const lockReleasedOnExit = false
+
+// 尝试创建锁文件，锁文件已经存在时返回false
+func tryLockFile(lockFilePath string) (*os.File, bool) {
+	lockFile, err := os.OpenFile(lockFilePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, false
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return lockFile, true
+}
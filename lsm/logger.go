@@ -0,0 +1,56 @@
+package lsm
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// 日志接口，msg是事件的描述，fields是依次排列的字段名和字段值，和log/slog的参数约定相同，
+// 因此*slog.Logger本身就实现了该接口。日志方法可能在持有LSM锁的时候被调用，不能再调用LSM的方法
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+// 丢弃所有日志，没有配置Logger时使用
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, fields ...interface{}) {}
+func (nopLogger) Info(msg string, fields ...interface{})  {}
+func (nopLogger) Warn(msg string, fields ...interface{})  {}
+func (nopLogger) Error(msg string, fields ...interface{}) {}
+
+// 把日志以“级别 描述 字段名=字段值 ...”的格式写到标准库的log.Logger
+type stdLogger struct {
+	logger *log.Logger
+}
+
+// 使用标准库的log.Logger输出日志，logger为空时使用log包默认的Logger，LSM不会修改它的任何设置
+func NewStdLogger(logger *log.Logger) Logger {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return stdLogger{logger: logger}
+}
+
+func (l stdLogger) Debug(msg string, fields ...interface{}) { l.output("DEBUG", msg, fields) }
+func (l stdLogger) Info(msg string, fields ...interface{})  { l.output("INFO", msg, fields) }
+func (l stdLogger) Warn(msg string, fields ...interface{})  { l.output("WARN", msg, fields) }
+func (l stdLogger) Error(msg string, fields ...interface{}) { l.output("ERROR", msg, fields) }
+
+func (l stdLogger) output(level string, msg string, fields []interface{}) {
+	var builder strings.Builder
+	builder.WriteString(level + " " + msg)
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 < len(fields) {
+			builder.WriteString(fmt.Sprintf(" %v=%v", fields[i], fields[i+1]))
+		} else {
+			// 落单的字段没有字段名
+			builder.WriteString(fmt.Sprintf(" !BADKEY=%v", fields[i]))
+		}
+	}
+	l.logger.Output(3, builder.String())
+}
@@ -0,0 +1,14 @@
+//go:build go1.21
+// +build go1.21
+
+package lsm
+
+import "log/slog"
+
+// 使用log/slog输出日志，logger为空时使用slog.Default()
+func NewSlogLogger(logger *slog.Logger) Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger
+}
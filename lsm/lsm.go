@@ -1,144 +1,456 @@
 package lsm
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/ryszard/goskiplist/skiplist"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 )
 
-func init() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-}
+// 记录的类型
+const (
+	typeValue    byte = iota // 普通的值
+	typeDeletion             // 删除标记，表示该key已经被删除
+	typeMerge                // 合并操作数，需要通过合并操作符合并到旧值上
+)
 
 type Data struct {
 	value     string
 	timestamp uint64 // 数据写入时的时间戳
+	kind      byte   // 记录的类型
+	ttl       uint64 // 数据的存活时长（纳秒），从写入时开始计算，为0表示永不过期
+}
+
+// 数据在指定的时间是否已经过期
+func (d Data) expired(now uint64) bool {
+	return d.ttl > 0 && d.timestamp+d.ttl <= now
+}
+
+// 数据在指定的时间是否存在，删除标记以及已经过期的数据都被视为不存在
+func (d Data) exists(now uint64) bool {
+	return d.kind != typeDeletion && !d.expired(now)
+}
+
+// 一条记录
+type record struct {
+	key    string
+	data   Data
+	family string // 记录所属列族的名称
+}
+
+// memTable中的key，同一个key的多个版本按照时间戳从新到旧排列
+type internalKey struct {
+	key       string
+	timestamp uint64
+}
+
+// 新建一个memTable，key按照比较器的顺序排列
+func newMemTable(comparator Comparator) *skiplist.SkipList {
+	return skiplist.NewCustomMap(func(l, r interface{}) bool {
+		left, right := l.(internalKey), r.(internalKey)
+		if c := comparator.Compare(left.key, right.key); c != 0 {
+			return c < 0
+		}
+		return left.timestamp > right.timestamp
+	})
 }
 
 // 索引信息
 type Index struct {
 	key    string
-	offset uint32 // 记录下指定key在段文件中偏移
+	offset uint32 // 记录下以该key结尾的数据块在段文件中的偏移
 }
 
-// LSM Tree
+// LSM Tree，直接在Lsm上进行的读写操作都作用于默认列族
 type Lsm struct {
-	path     string
-	memTable *skiplist.SkipList
+	*ColumnFamily                          // 默认列族，数据文件直接保存在LSM的目录中
+	families      map[string]*ColumnFamily // 所有打开的列族，包括默认列族
+	mutex         sync.RWMutex             // 保护所有列族的memTable以及写入操作
+	lastTimestamp uint64                   // 最后一次写入使用的时间戳，写入的时间戳严格递增
+
+	snapshotMutex sync.Mutex
+	snapshots     map[*Snapshot]bool // 所有存活的快照
 
 	transLogFile       *os.File
-	transLogStrictSync bool // transLog是否需要严格同步
+	transLogStrictSync bool        // transLog是否需要严格同步
+	blockCache         *BlockCache // 数据块缓存，所有列族共享
+	lockFile           *os.File    // 持有目录写锁的锁文件
 	closed             bool
+	done               chan bool      // 在LSM关闭时被关闭，通知后台协程退出
+	background         sync.WaitGroup // 所有后台协程
+	metrics            *Metrics       // 指标注册表
+	flushDuration      *Histogram     // 同步memTable的耗时
+	logger             Logger
+	listener           EventListener
 }
 
+// LSM的配置项
+type Options struct {
+	TransLogStrictSync bool        // 是否开启严格的事务日志同步模式
+	Compression        Compression // 段文件数据块使用的压缩算法
+	BlockCache         *BlockCache // 数据块缓存，为空时使用进程内共享的默认缓存
+	RowCacheSize       int64       // 行缓存最多占用的字节数，为0时不使用行缓存
+
+	// 多版本模式，两者都为0时只保留每个key的最新版本（以及存活快照需要的版本），
+	// 否则旧版本满足任意一个限制就会被保留：它是最新的MaxVersions个版本之一，或者在VersionRetention之内写入，为0的限制不生效
+	MaxVersions      int           // 每个key至少保留的最新版本数
+	VersionRetention time.Duration // 保留在该时长内写入的所有旧版本
+
+	// 合并操作符，调用Merge之前必须配置，之后打开包含合并操作数的数据时也需要配置同样的合并操作符
+	MergeOperator MergeOperator
+
+	// key的比较器，为空时使用数据已经保存的内置比较器或者BytewiseComparator，同一份数据必须始终使用同名的比较器
+	Comparator Comparator
+
+	// 指标注册表，为空时LSM的指标只能通过Stats获取；列族使用LSM的注册表，不需要单独配置
+	Metrics *Metrics
+
+	// 日志输出，为空时不输出任何日志；列族使用LSM的Logger，不需要单独配置
+	Logger Logger
+
+	// 事件监听器，为空时不通知任何事件；列族使用LSM的监听器，不需要单独配置
+	EventListener EventListener
+
+	// 只对Reader生效的配置项
+	RefreshInterval time.Duration // Reader自动刷新的时间间隔，为0时只在调用Refresh时刷新
+	TailTransLog    bool          // Reader是否读取transLog中还没有同步到段文件的数据（只包括默认列族）
+}
+
+var ErrClosed = errors.New("lsm is closed")
+
 // 保存一组key,value
-func (l *Lsm) Set(key string, value string) {
-	data := Data{value: value, timestamp: uint64(time.Now().UnixNano())}
-	l.appendTransLog(key, data) // 写transLog
-	l.memTable.Set(key, data)
-	if l.memTable.Len()%memTableCheckInterval == 0 {
-		memTableSize := l.getMemTableSize()
-		if memTableSize > thresholdSize {
-			l.SyncMemTable()
+func (cf *ColumnFamily) Set(key string, value string) error {
+	return cf.write(key, Data{value: value, kind: typeValue})
+}
+
+// 保存一组key,value，ctx在获取写锁之前或者之后已经被取消时不会写入数据并返回ctx.Err()
+func (cf *ColumnFamily) SetContext(ctx context.Context, key string, value string) error {
+	return cf.writeContext(ctx, key, Data{value: value, kind: typeValue})
+}
+
+// 保存一组key,value，数据在ttl之后过期，过期的数据不会再被读取到，并且会在合并时被清理
+func (cf *ColumnFamily) SetWithTTL(key string, value string, ttl time.Duration) error {
+	return cf.write(key, Data{value: value, kind: typeValue, ttl: uint64(ttl)})
+}
+
+// 删除一个key
+func (cf *ColumnFamily) Delete(key string) error {
+	return cf.write(key, Data{kind: typeDeletion})
+}
+
+// 写入一条记录
+func (cf *ColumnFamily) write(key string, data Data) error {
+	return cf.writeContext(context.Background(), key, data)
+}
+
+func (cf *ColumnFamily) writeContext(ctx context.Context, key string, data Data) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cf.lsm.mutex.Lock()
+	defer cf.lsm.mutex.Unlock()
+	// 等待写锁的过程中ctx可能已经被取消
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cf.lsm.writeRecords([]record{{key, data, cf.name}})
+}
+
+// 原子地写入一组记录，所有记录使用同一个时间戳，因此对快照来说它们要么全部可见要么全部不可见，调用者需要持有写锁。
+// LSM已经关闭时返回ErrClosed
+func (l *Lsm) writeRecords(records []record) error {
+	if l.closed {
+		return ErrClosed
+	}
+	timestamp := l.nextTimestamp()
+	for i := range records {
+		records[i].data.timestamp = timestamp
+	}
+	l.appendTransLog(records) // 写transLog
+	families := make(map[*ColumnFamily]bool)
+	for _, r := range records {
+		cf := l.families[r.family]
+		cf.memTable.Set(internalKey{r.key, timestamp}, r.data)
+		cf.pruneMemTable(r.key)
+		cf.rowCache.invalidate(r.key)
+		families[cf] = true
+	}
+	// 所有列族共享同一个transLog，因此任意一个列族的memTable过大时需要同步所有的列族
+	for cf := range families {
+		if cf.memTable.Len()%memTableCheckInterval == 0 {
+			memTableSize := getMemTableSize(cf.memTable)
+			if memTableSize > thresholdSize {
+				if err := l.syncMemTable(context.Background()); err != nil {
+					log.Fatal(err)
+				}
+				break
+			}
 		}
 	}
+	return nil
 }
 
-// 把当前memTable中的内容全部同步到SSTable中去
-func (l *Lsm) SyncMemTable() {
-	var err error
-	err = l.createSortedStringTable()
+// 分配一个新的时间戳，保证时间戳严格递增，因此时间戳也可以作为写入的序列号
+func (l *Lsm) nextTimestamp() uint64 {
+	timestamp := uint64(time.Now().UnixNano())
+	if timestamp <= l.lastTimestamp {
+		timestamp = l.lastTimestamp + 1
+	}
+	l.lastTimestamp = timestamp
+	return timestamp
+}
+
+// 清理memTable中key已经不再被需要的旧版本，并合并其中的合并操作数
+func (cf *ColumnFamily) pruneMemTable(key string) {
+	iter := cf.memTable.Seek(internalKey{key, math.MaxUint64})
+	if iter == nil {
+		return
+	}
+	versions := make([]Data, 0)
+	for ok := true; ok && iter.Key().(internalKey).key == key; ok = iter.Next() {
+		versions = append(versions, iter.Value().(Data))
+	}
+	iter.Close()
+	if len(versions) == 1 && versions[0].kind != typeMerge {
+		return
+	}
+	for _, data := range versions {
+		cf.memTable.Delete(internalKey{key, data.timestamp})
+	}
+	for _, data := range cf.newVersionFilter().compact(key, versions) {
+		cf.memTable.Set(internalKey{key, data.timestamp}, data)
+	}
+}
+
+// 把所有列族当前memTable中的内容全部同步到SSTable中去
+func (l *Lsm) SyncMemTable() error {
+	return l.SyncMemTableContext(context.Background())
+}
+
+// 和SyncMemTable相同，每写入一条记录之前都会检查ctx，ctx被取消时正在写入的段文件会被删除，
+// 还没有同步的数据仍然保留在memTable和transLog中，返回ctx.Err()
+func (l *Lsm) SyncMemTableContext(ctx context.Context) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.syncMemTable(ctx)
+}
+
+// 同步失败时返回错误，此时transLog不会被清空，没有同步的数据在下次打开时从transLog中恢复
+func (l *Lsm) syncMemTable(ctx context.Context) error {
+	start := time.Now()
+	for _, cf := range l.families {
+		err := cf.createSortedStringTable(ctx)
+		if err != nil {
+			return err
+		}
+		// 重置memTable
+		cf.memTable = newMemTable(cf.comparator)
+	}
+	// 所有列族的数据都已经保存到SSTable中之后才能清空transLog
+	info, err := l.transLogFile.Stat()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	// 重置memTable
-	l.memTable = skiplist.NewStringMap()
 	err = l.resetTransLogFile()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	l.listener.OnWALRotated(WALRotatedInfo{Path: l.transLogFile.Name(), Bytes: info.Size()})
+	l.flushDuration.Observe(time.Since(start).Seconds())
+	return nil
 }
 
-// 关闭LSM，释放占用的资源
-func (l *Lsm) Close() {
+// 关闭LSM，释放占用的资源。
+// Close会通知后台协程退出并等待它们结束，正在进行的合并会先完成；之后的写入以及返回error的读取都返回ErrClosed，
+// Get、Has、MultiGet、Scan等没有返回error的读取则读取不到任何数据，需要区分时使用GetContext或者NewIteratorContext。
+// 同步memTable或者删除transLog失败时返回错误，此时transLog会被保留，下次打开时从中恢复数据，目录的写锁仍然会被释放。
+// 重复调用Close不会产生任何效果
+func (l *Lsm) Close() error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil
+	}
 	l.closed = true
+	close(l.done)
+	l.mutex.Unlock()
+	l.background.Wait()
 
-	l.SyncMemTable() // 关闭前同步数据
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	err := l.syncMemTable(context.Background()) // 关闭前同步数据
 
-	var err error
 	// 关闭日志文件
-	err = l.transLogFile.Close()
-	if err != nil {
-		log.Fatal(err)
+	if closeErr := l.transLogFile.Close(); err == nil {
+		err = closeErr
+	}
+	// 所有数据都已经同步之后才能删除日志文件
+	if err == nil {
+		err = os.Remove(l.transLogFile.Name())
 	}
-	// 删除日志文件
-	err = os.Remove(l.transLogFile.Name())
 	if err != nil {
-		log.Fatal(err)
+		l.logger.Error("close failed", "director", l.path, "error", err)
+	}
+
+	// 释放目录的写锁
+	unlockDirector(l.lockFile)
+	l.logger.Info("lock released", "director", l.path)
+	return err
+}
+
+// 获取段文件的压缩统计信息
+func (cf *ColumnFamily) CompressionStats() CompressionStats {
+	return getCompressionStats(getAvailableIndexFilesPath(cf.path))
+}
+
+// 获取列族的统计信息
+func (cf *ColumnFamily) Stats() Stats {
+	cf.lsm.mutex.RLock()
+	stats, segments := cf.stats()
+	cf.lsm.mutex.RUnlock()
+	// 压缩统计信息需要读取所有数据块的头部，不能在持有锁的时候获取，否则会阻塞写入
+	stats.Compression = getCompressionStats(segments)
+	return stats
+}
+
+// 同时返回统计时的段文件，用于在释放锁之后获取压缩统计信息，调用者需要持有读锁
+func (cf *ColumnFamily) stats() (Stats, []string) {
+	v := cf.view()
+	stats := v.stats()
+	stats.Gets = cf.segmentReads.Count()
+	stats.SegmentReads = uint64(cf.segmentReads.Sum())
+	stats.Merges = cf.mergeDuration.Count()
+	stats.MergeDuration = time.Duration(cf.mergeDuration.Sum() * float64(time.Second))
+	stats.MergeBytes = uint64(cf.mergeBytes.Value())
+	return stats, v.segments
+}
+
+// 获取LSM的统计信息，顶层字段包括整个LSM的信息以及默认列族的信息，Families中是每个列族各自的统计信息
+func (l *Lsm) Stats() Stats {
+	l.mutex.RLock()
+	families := make(map[string]Stats, len(l.families))
+	segments := make(map[string][]string, len(l.families))
+	for name, cf := range l.families {
+		families[name], segments[name] = cf.stats()
+	}
+	transLogBytes := l.transLogBytes()
+	l.mutex.RUnlock()
+	// 压缩统计信息需要读取所有数据块的头部，在释放锁之后获取
+	for name := range families {
+		familyStats := families[name]
+		familyStats.Compression = getCompressionStats(segments[name])
+		families[name] = familyStats
 	}
+	stats := families[defaultColumnFamily]
+	stats.TransLogBytes = transLogBytes
+	stats.Flushes = l.flushDuration.Count()
+	stats.FlushDuration = time.Duration(l.flushDuration.Sum() * float64(time.Second))
+	stats.Families = families
+	return stats
+}
 
-	// 删除锁文件
-	err = os.Remove(path.Join(l.path, writeLockFile))
+// transLog当前的大小，调用者需要持有读锁
+func (l *Lsm) transLogBytes() int64 {
+	if l.closed {
+		return 0
+	}
+	info, err := l.transLogFile.Stat()
 	if err != nil {
 		log.Fatal(err)
 	}
+	return info.Size()
+}
+
+// 获取数据块缓存的统计信息
+func (l *Lsm) BlockCacheStats() CacheStats {
+	return l.blockCache.Stats()
+}
+
+// 获取行缓存的统计信息
+func (cf *ColumnFamily) RowCacheStats() CacheStats {
+	return cf.rowCache.stats()
 }
 
 // 获取memTable所占用的空间大小
-func (l *Lsm) getMemTableSize() uint64 {
+func getMemTableSize(memTable *skiplist.SkipList) uint64 {
 	var memTableSize uint64 // 内存中占用的空间
-	iterator := l.memTable.Iterator()
+	iterator := memTable.Iterator()
 	for iterator.Next() {
-		key := iterator.Key().(string)
+		key := iterator.Key().(internalKey).key
 		data := iterator.Value().(Data)
-		memTableSize = memTableSize + uint64(len(key)) + uint64(len(data.value)) + 8
+		memTableSize = memTableSize + uint64(len(key)) + uint64(len(data.value)) + 10
 	}
 	return memTableSize
 }
 
 // 创建SSTable
-func (l *Lsm) createSortedStringTable() error {
+func (cf *ColumnFamily) createSortedStringTable(ctx context.Context) error {
 	// 没有数据则无需保存
-	if l.memTable.Len() == 0 {
+	if cf.memTable.Len() == 0 {
 		return nil
 	}
-
-	buf := make([]byte, 0)      // 段文件内容
-	indexBuf := make([]byte, 0) // 索引文件内容
-	i := uint64(0)              // 记录当前已保存的数据条数
-
-	iter := l.memTable.Iterator()
-	for iter.Next() {
-		key := iter.Key().(string)
-		data := iter.Value().(Data)
-
-		if i%indexOffset == 0 || i+1 == uint64(l.memTable.Len()) {
-			// 把段文件中的稀疏的key的offset信息写到索引中
-			indexOffset := append(addBufHead([]byte(key)), uint32ToBytes(uint32(len(buf)))...)
-			indexBuf = append(indexBuf, indexOffset...)
-		}
-		i += 1
-		buf = append(buf, encodeKeyAndData(key, data)...)
-	}
+	start := time.Now()
+	flushInfo := FlushInfo{Family: cf.name, Records: cf.memTable.Len()}
+	cf.lsm.listener.OnFlushBegin(flushInfo)
 
 	// 段文件
-	segmentFileName := generateSegmentFileName(l.path)
-	err := ioutil.WriteFile(path.Join(l.path, segmentFileName), buf, 0666)
+	segmentFileName := generateSegmentFileName(cf.path)
+	segFile, err := os.Create(path.Join(cf.path, segmentFileName))
 	if err != nil {
 		return err
 	}
-
 	// 索引文件
 	indexFileName := strings.Replace(segmentFileName, segmentFileSuffix, indexFileSuffix, -1)
-	err = ioutil.WriteFile(path.Join(l.path, indexFileName), indexBuf, 0666)
+	indexFile, err := os.Create(path.Join(cf.path, indexFileName))
+	if err != nil {
+		segFile.Close()
+		os.Remove(segFile.Name())
+		return err
+	}
+
+	compactor := newCompactor(cf.newVersionFilter(), newSegmentWriter(segFile, indexFile, cf.compression))
+	iter := cf.memTable.Iterator()
+	for err == nil && iter.Next() {
+		if err = ctx.Err(); err == nil {
+			compactor.add(iter.Key().(internalKey).key, iter.Value().(Data))
+		}
+	}
+	iter.Close()
+	if err == nil {
+		err = compactor.finish()
+	}
+	if closeErr := segFile.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := indexFile.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		// 删除没有写完的段文件，它还没有出现在清单中，memTable中的数据仍然保留
+		os.Remove(segFile.Name())
+		os.Remove(indexFile.Name())
+		flushInfo.Duration, flushInfo.Err = time.Since(start), err
+		cf.lsm.listener.OnFlushEnd(flushInfo)
 		return err
 	}
+	// 段文件完整写入之后才能出现在清单中
+	cf.updateManifest()
+	cf.lsm.logger.Info("memTable flushed", "family", cf.name, "segment", segFile.Name(),
+		"records", cf.memTable.Len(), "duration", time.Since(start))
+	flushInfo.Segment, flushInfo.Bytes = segFile.Name(), getFilesBytes([]string{segFile.Name()})
+	flushInfo.Duration = time.Since(start)
+	cf.lsm.listener.OnFlushEnd(flushInfo)
 	return nil
 }
 
@@ -153,6 +465,10 @@ func (l *Lsm) resetTransLogFile() error {
 	if err != nil {
 		return err
 	}
+	_, err = l.transLogFile.WriteString(transLogHeader)
+	if err != nil {
+		return err
+	}
 	if l.transLogStrictSync {
 		err = l.transLogFile.Sync()
 		if err != nil {
@@ -162,127 +478,99 @@ func (l *Lsm) resetTransLogFile() error {
 	return nil
 }
 
-// 通过key获取值
-func (l *Lsm) Get(key string) (string, bool) {
-	memValue, ok := l.memTable.Get(key)
-	if ok {
-		return memValue.(Data).value, true
-	}
-
-	// 如果在memTable中没取到数据则需要去seg文件中进行查询
-	valueTimestamp := uint64(0) // 当前值的时间
-	value := ""                 // 最大时间对于的值
-
-	// 根据得到的data来决定是否更新最终value的值
-	var setValue = func(data Data) {
-		if data.timestamp > valueTimestamp {
-			value = data.value              // 更新值的内容
-			ok = true                       // 已经找到了对应的值
-			valueTimestamp = data.timestamp // 更新该值对应的时间戳
-		}
-	}
-
-	indexFilesPath := getIndexFilesPath(l.path)
-	// 根据所有的索引文件，去对应的段文件中检索数据
-	for _, indexFilePath := range indexFilesPath {
-		segFilePath := strings.Replace(indexFilePath, indexFileSuffix, segmentFileSuffix, -1)
-		if _, err := os.Stat(strings.Replace(indexFilePath, indexFileSuffix, unavailableFileSuffix, -1)); !os.IsNotExist(err) {
-			// 如果当前段文件存在对应的ua文件，则跳过此文件
-			continue
+// 每隔一段时间把transLog中的数据落盘，直到LSM被关闭
+func (l *Lsm) syncTransLogPeriodically() {
+	defer l.background.Done()
+	ticker := time.NewTicker(time.Second * transLogAsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
 		}
-
-		var err error
-		indexData, err := ioutil.ReadFile(indexFilePath)
+		// transLog在同步memTable时会被替换，需要持有读锁
+		l.mutex.RLock()
+		err := l.transLogFile.Sync()
+		l.mutex.RUnlock()
 		if err != nil {
+			l.logger.Error("transLog sync failed", "error", err)
+			l.listener.OnBackgroundError(err)
 			log.Fatal(err)
 		}
+	}
+}
 
-		indices := getIndexList(indexData)
-		length := len(indices)
-		offsetLeft := uint32(0)  // 可检索范围内的最小索引下标
-		offsetRight := uint32(0) // 可检索范围内的最大索引下标
-		// 0或1个索引是没有意义的
-		if length > 1 {
-			// 超过范围，无法被找到，跳过该索引文件
-			if key < indices[0].key || key > indices[length-1].key {
-				continue
-			}
-			for i := 0; i < length; i++ {
-				// 直接命中索引
-				if indices[i].key == key {
-					offsetLeft = indices[i].offset
-					offsetRight = offsetLeft
-					break
-				}
-				// 最后一个元素都没有命中，索引命中失败，需要全文检索
-				if i == length-1 {
-					break
-				}
-				// 索引范围命中，确定值应在指定的范围之中
-				if indices[i].key < key && key < indices[i+1].key {
-					offsetLeft = indices[i].offset
-					offsetRight = indices[i+1].offset
-					break
-				}
-			}
-		}
+// 通过key获取值，LSM关闭之后总是返回false，需要区分key不存在和ErrClosed时使用GetContext
+func (cf *ColumnFamily) Get(key string) (string, bool) {
+	value, ok, _ := cf.GetContext(context.Background(), key)
+	return value, ok
+}
 
-		segFile, err := os.Open(segFilePath)
-		if err != nil {
-			log.Fatal(err)
-		}
-		size := getFileSize(segFile)
-
-		if offsetLeft == 0 && offsetRight == 0 {
-			// 1. 索引失效
-			for {
-				thisKey, data := readKeyAndData(segFile)
-				if thisKey == key { // 取到对应的值
-					setValue(data)
-					break
-				}
+// 通过key获取值，每查找一个段文件之前都会检查ctx，ctx被取消时返回ctx.Err()，
+// 需要合并操作数但是没有配置合并操作符时返回ErrNoMergeOperator，LSM已经关闭时返回ErrClosed
+func (cf *ColumnFamily) GetContext(ctx context.Context, key string) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+	cf.lsm.mutex.RLock()
+	defer cf.lsm.mutex.RUnlock()
+	if cf.lsm.closed {
+		return "", false, ErrClosed
+	}
+	v := cf.view()
+	v.ctx = ctx
+	value, ok, err := v.get(key, math.MaxUint64, uint64(time.Now().UnixNano()))
+	if err == nil {
+		cf.segmentReads.Observe(float64(v.segmentReads))
+	}
+	return value, ok, err
+}
 
-				position := getCurrentPosition(segFile)
-				if position == size {
-					// 最终也没能找到对应的值
-					break
-				}
-			}
-		} else if offsetLeft == offsetRight {
-			// 2. 索引精确命中
-			setCurrentPosition(segFile, offsetLeft)
-			_, data := readKeyAndData(segFile)
-			setValue(data)
-		} else if offsetLeft < offsetRight {
-			// 3. 索引范围命中
-			setCurrentPosition(segFile, offsetLeft) // 从左开始查找
-
-			for {
-				thisKey, data := readKeyAndData(segFile)
-				if thisKey == key {
-					setValue(data)
-					break
-				}
+// key当前是否存在，LSM关闭之后总是返回false
+func (cf *ColumnFamily) Has(key string) bool {
+	_, ok := cf.Get(key)
+	return ok
+}
 
-				position := getCurrentPosition(segFile)
-				if uint32(position) >= offsetRight {
-					break
-				}
-			}
-		}
+// 获取一组key的值，返回的值以及是否存在的标记和keys的顺序一致，LSM关闭之后所有key都不存在
+func (cf *ColumnFamily) MultiGet(keys []string) ([]string, []bool) {
+	cf.lsm.mutex.RLock()
+	defer cf.lsm.mutex.RUnlock()
+	values, found, _ := cf.view().multiGet(keys, math.MaxUint64, uint64(time.Now().UnixNano()))
+	return values, found
+}
 
-		err = segFile.Close()
-		if err != nil {
-			log.Fatal(err)
-		}
+// 按照比较器的顺序访问[start, end)范围内当前存在的key，start为空表示从第一个key开始，end为空表示没有上界，
+// visit返回false时停止遍历。LSM关闭之后不会访问任何key，需要区分时使用NewIteratorContext并检查Err
+func (cf *ColumnFamily) Scan(start string, end string, visit func(key string, value string) bool) {
+	scan(cf.NewIterator(), cf.comparator, start, end, visit)
+}
+
+// 查找key时间戳不大于timestamp的最新记录，返回的记录可能是删除标记
+func (cf *ColumnFamily) search(key string, timestamp uint64) (Data, bool) {
+	// 视图没有设置ctx，因此不会返回错误
+	data, ok, _ := cf.view().search(key, timestamp)
+	return data, ok
+}
+
+// 在memTable中查找key时间戳不大于timestamp的最新记录
+func searchMemTable(memTable *skiplist.SkipList, key string, timestamp uint64) (Data, bool) {
+	iter := memTable.Seek(internalKey{key, timestamp})
+	if iter == nil {
+		return Data{}, false
 	}
-	return value, ok
+	defer iter.Close()
+	if iter.Key().(internalKey).key != key {
+		return Data{}, false
+	}
+	return iter.Value().(Data), true
 }
 
-// 每一条记录都需要写到transLog保证数据不会因为内存断电而丢失
-func (l *Lsm) appendTransLog(key string, data Data) {
+// 每一组记录都需要作为一个整体写到transLog保证数据不会因为内存断电而丢失
+func (l *Lsm) appendTransLog(records []record) {
 	var err error
-	_, err = l.transLogFile.Write(encodeKeyAndData(key, data))
+	_, err = l.transLogFile.Write(encodeTransLogEntry(records))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -295,89 +583,204 @@ func (l *Lsm) appendTransLog(key string, data Data) {
 	}
 }
 
-// 恢复transLog中的数据，并把其数据写到SSTable中
-func restoreTransLogData(lsm *Lsm, transLogFilePath string) {
+// 读取transLog中所有完整的条目，transLog中间的条目损坏时返回错误
+func readTransLog(transLogFilePath string, logger Logger) ([][]record, error) {
 	logData, err := ioutil.ReadFile(transLogFilePath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if len(logData) > 0 {
-		for len(logData) > 0 {
-			key, data, length := decodeKeyAndData(logData)
-			lsm.memTable.Set(key, data)
-			logData = logData[length:]
+	entries, valid, err := decodeTransLog(logData)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", transLogFilePath, err)
+	}
+	if valid < len(logData) {
+		// 进程崩溃时最后一组记录可能没有完整的写入，丢弃这组记录以保证原子性
+		logger.Warn("discard incomplete transLog data", "path", transLogFilePath, "bytes", len(logData)-valid)
+	}
+	return entries, nil
+}
+
+// 恢复transLog中的数据，并把其数据写到SSTable中，返回恢复的条目数。
+// 其他列族在恢复时还没有被打开，无法得知它们的比较器，因此它们的记录会被转存到列族目录中的transLog里，在列族被打开时再恢复
+func restoreTransLogData(lsm *Lsm, transLogFilePath string) (int, error) {
+	familyLogs := make(map[string][]byte)
+	entries, err := readTransLog(transLogFilePath, lsm.logger)
+	if err != nil {
+		return 0, err
+	}
+	for _, records := range entries {
+		others := make(map[string][]record)
+		for _, r := range records {
+			if r.data.timestamp > lsm.lastTimestamp {
+				lsm.lastTimestamp = r.data.timestamp
+			}
+			if r.family == defaultColumnFamily {
+				lsm.memTable.Set(internalKey{r.key, r.data.timestamp}, r.data)
+			} else {
+				others[r.family] = append(others[r.family], r)
+			}
 		}
-		// 把恢复的数据写到SSTable中
-		err = lsm.createSortedStringTable()
+		for family, records := range others {
+			familyLogs[family] = append(familyLogs[family], encodeTransLogEntry(records)...)
+		}
+	}
+	for family, logData := range familyLogs {
+		director := path.Join(lsm.path, family)
+		err := os.MkdirAll(director, 0755)
 		if err != nil {
 			log.Fatal(err)
 		}
-		// 日志数据恢复完毕重置memTable
-		lsm.memTable = skiplist.NewStringMap()
+		familyLogFilePath := path.Join(director, transLog)
+		if _, err := os.Stat(familyLogFilePath); os.IsNotExist(err) {
+			logData = append([]byte(transLogHeader), logData...)
+		}
+		appendFile(familyLogFilePath, logData)
 	}
+	lsm.restore(nil)
+	return len(entries), nil
+}
+
+// 把恢复到memTable中的数据以及entries中的记录写到SSTable中
+func (cf *ColumnFamily) restore(entries [][]record) {
+	for _, records := range entries {
+		for _, r := range records {
+			cf.memTable.Set(internalKey{r.key, r.data.timestamp}, r.data)
+		}
+	}
+	err := cf.createSortedStringTable(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	// 日志数据恢复完毕重置memTable
+	cf.memTable = newMemTable(cf.comparator)
 }
 
 // 后台对数据文件进行合并
-func (l *Lsm) backgroundMerge() {
+func (cf *ColumnFamily) backgroundMerge() {
+	defer cf.lsm.background.Done()
 	ticker := time.NewTicker(time.Second * mergeCheckInterval)
-	for range ticker.C {
-		if l.closed {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cf.lsm.done:
 			return
+		case <-ticker.C:
 		}
-		// 存在不可用文件就跳过合并操作
-		if isFileSuffixExist(l.path, unavailableFileSuffix) {
-			continue
-		}
-		indexFilesPath := getIndexFilesPath(l.path)
-		if len(indexFilesPath) > maxSegmentFileSize {
-			file1, file2 := getTwoSmallFiles(indexFilesPath)
+		cf.backgroundMergeOnce()
+	}
+}
 
-			segFile1, err := os.Open(file1)
-			if err != nil {
-				log.Fatal(err)
-			}
-			segFile2, err := os.Open(file2)
-			if err != nil {
-				log.Fatal(err)
-			}
+// 进行一次后台合并，失败时通知监听器，原有的段文件保持不变，下一次检查时会再次尝试
+func (cf *ColumnFamily) backgroundMergeOnce() {
+	if err := cf.mergeSmallSegments(); err != nil {
+		cf.lsm.logger.Error("background merge failed", "family", cf.name, "error", err)
+		cf.lsm.listener.OnBackgroundError(err)
+	}
+}
 
-			segFile := createNewSegFile(l.path)
-			merge(segFile1, segFile2, segFile)
+// 段文件的数量超过限制时合并其中两个较小的段文件，删除废弃的段文件或者合并失败时返回错误
+func (cf *ColumnFamily) mergeSmallSegments() error {
+	// 和手动合并互斥
+	cf.compactionMutex.Lock()
+	defer cf.compactionMutex.Unlock()
+	if err := cf.removeObsoleteSegments(); err != nil {
+		return err
+	}
+	// 存在不可用文件就跳过合并操作
+	if isFileSuffixExist(cf.path, unavailableFileSuffix) {
+		return nil
+	}
+	indexFilesPath := getIndexFilesPath(cf.path)
+	if len(indexFilesPath) <= maxSegmentFileSize {
+		return nil
+	}
+	file1, file2 := getTwoSmallFiles(indexFilesPath)
 
-			closeFile(segFile1)
-			closeFile(segFile2)
-			closeFile(segFile)
+	start := time.Now()
+	compactionInfo := CompactionInfo{Family: cf.name, Inputs: []string{file1, file2}}
+	compactionInfo.InputBytes = getFilesBytes(compactionInfo.Inputs)
+	cf.lsm.listener.OnCompactionBegin(compactionInfo)
+	output, err := cf.mergeTwoSegments(file1, file2)
+	if err != nil {
+		compactionInfo.Duration, compactionInfo.Err = time.Since(start), err
+		cf.lsm.listener.OnCompactionEnd(compactionInfo)
+		return err
+	}
+	cf.observeMerge(start, output)
+	cf.lsm.logger.Info("segments merged", "family", cf.name, "inputs", compactionInfo.Inputs,
+		"output", output, "duration", time.Since(start))
+	cf.updateManifest()
+	compactionInfo.Output, compactionInfo.OutputBytes = output, getFilesBytes([]string{output})
+	compactionInfo.Duration = time.Since(start)
+	cf.lsm.listener.OnCompactionEnd(compactionInfo)
+	cf.lsm.mutex.Lock()
+	cf.rowCache.invalidateAll()
+	cf.lsm.mutex.Unlock()
+	// 在旧的段文件被打上废弃标签后，为了防止当前还有进程在读取此段文件，需要等待一段时间后再删除该文件；
+	// LSM关闭时还没有删除的段文件带有不可用标志，会在下一次打开之后被删除
+	cf.markObsolete(compactionInfo.Inputs)
+	return nil
+}
 
-			// 移除新创建文件的不可用标志，表示新创建的文件已经可以被读取
-			removeFile(strings.Replace(segFile.Name(), segmentFileSuffix, unavailableFileSuffix, -1))
-			// 给旧的文件创建不可读标志
-			uaFile1Path := strings.Replace(segFile1.Name(), segmentFileSuffix, unavailableFileSuffix, -1)
-			uaFile1, err := os.Create(uaFile1Path)
-			if err != nil {
-				log.Fatal(err)
-			}
-			closeFile(uaFile1)
-			uaFile2Path := strings.Replace(segFile2.Name(), segmentFileSuffix, unavailableFileSuffix, -1)
-			uaFile2, err := os.Create(uaFile2Path)
-			if err != nil {
-				log.Fatal(err)
+// 把两个段文件合并为一个新的段文件，并给旧的段文件打上不可用标志，返回新的段文件。
+// 失败时删除没有完成的新段文件以及已经创建的不可用标志，所有的段文件都保持合并之前的状态
+func (cf *ColumnFamily) mergeTwoSegments(file1, file2 string) (string, error) {
+	segFile1, err := os.Open(file1)
+	if err != nil {
+		return "", err
+	}
+	defer segFile1.Close()
+	segFile2, err := os.Open(file2)
+	if err != nil {
+		return "", err
+	}
+	defer segFile2.Close()
+
+	segFile, err := newSegFile(cf.path)
+	if err != nil {
+		return "", err
+	}
+	uaFilePath := strings.Replace(segFile.Name(), segmentFileSuffix, unavailableFileSuffix, -1)
+	err = merge(segFile1, segFile2, segFile, cf.compression, cf.comparator, cf.newCompactionFilter([]string{file1, file2}))
+	if closeErr := segFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// 没有写完的段文件带有不可用标志，因此不会被读取到
+		os.Remove(strings.Replace(segFile.Name(), segmentFileSuffix, indexFileSuffix, -1))
+		os.Remove(segFile.Name())
+		os.Remove(uaFilePath)
+		return "", err
+	}
+	// 移除新创建文件的不可用标志，表示新创建的文件已经可以被读取
+	if err := os.Remove(uaFilePath); err != nil {
+		return "", err
+	}
+	// 给旧的文件创建不可读标志，新旧段文件中的数据相同，因此失败时同时读取它们不会产生错误的结果
+	created := make([]string, 0, 2)
+	for _, segFilePath := range []string{file1, file2} {
+		uaFile, err := os.Create(strings.Replace(segFilePath, segmentFileSuffix, unavailableFileSuffix, -1))
+		if err == nil {
+			created = append(created, uaFile.Name())
+			err = uaFile.Close()
+		}
+		if err != nil {
+			for _, uaFilePath := range created {
+				os.Remove(uaFilePath)
 			}
-			closeFile(uaFile2)
-			// 在旧的段文件被打上废弃标签后，为了防止当前还有进程在读取此段文件，需要等待一段时间后再删除该文件
-			time.Sleep(time.Second * waitOldSegFileDelTime)
-			// 删除段文件，索引文件，不可用文件
-			removeFile(segFile1.Name())
-			removeFile(strings.Replace(segFile1.Name(), segmentFileSuffix, indexFileSuffix, -1))
-			removeFile(uaFile1Path)
-			removeFile(segFile2.Name())
-			removeFile(strings.Replace(segFile2.Name(), segmentFileSuffix, indexFileSuffix, -1))
-			removeFile(uaFile2Path)
+			return "", err
 		}
 	}
+	return segFile.Name(), nil
 }
 
 // 新建一个LSM，数据文件的目录地址，是否开启严格的事务日志同步模式
 func NewLsm(director string, transLogStrictSync bool) (*Lsm, error) {
+	return NewLsmWithOptions(director, Options{TransLogStrictSync: transLogStrictSync})
+}
+
+// 使用指定的配置项新建一个LSM
+func NewLsmWithOptions(director string, options Options) (*Lsm, error) {
 	if director == "" {
 		dir, err := os.Getwd()
 		if err != nil {
@@ -386,30 +789,55 @@ func NewLsm(director string, transLogStrictSync bool) (*Lsm, error) {
 		director = dir
 	}
 
-	lockFilePath := path.Join(director, writeLockFile)
-	if _, err := os.Stat(lockFilePath); !os.IsNotExist(err) {
-		return nil, errors.New("Director " + director + " has been used for another LSM Tree")
-	}
-	lockFile, err := os.Create(lockFilePath)
+	lockFile, err := lockDirector(director)
 	if err != nil {
-		log.Fatal(err)
-	}
-	err = lockFile.Close()
-	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	lsm := &Lsm{
-		path:               director,
-		memTable:           skiplist.NewStringMap(),
-		transLogStrictSync: transLogStrictSync,
+		families:           make(map[string]*ColumnFamily),
+		lastTimestamp:      uint64(time.Now().UnixNano()),
+		snapshots:          make(map[*Snapshot]bool),
+		transLogStrictSync: options.TransLogStrictSync,
+		blockCache:         options.BlockCache,
+		lockFile:           lockFile,
 		closed:             false,
+		done:               make(chan bool),
+		metrics:            options.Metrics,
+		logger:             options.Logger,
+		listener:           options.EventListener,
+	}
+	if lsm.listener == nil {
+		lsm.listener = BaseEventListener{}
 	}
+	if lsm.logger == nil {
+		lsm.logger = nopLogger{}
+	}
+	lsm.logger.Info("lock acquired", "director", director, "pid", os.Getpid())
+	if lsm.blockCache == nil {
+		lsm.blockCache = defaultBlockCache
+	}
+	if lsm.metrics == nil {
+		lsm.metrics = NewMetrics()
+	}
+	lsm.registerMetrics()
+	lsm.ColumnFamily, err = newColumnFamily(lsm, defaultColumnFamily, director, options)
+	if err != nil {
+		unlockDirector(lockFile)
+		return nil, err
+	}
+	lsm.families[defaultColumnFamily] = lsm.ColumnFamily
 	transLogFilePath := path.Join(director, transLog)
 	// 如果transLog文件存在则需要先从日志文件中恢复数据
 	if _, err := os.Stat(transLogFilePath); !os.IsNotExist(err) {
-		restoreTransLogData(lsm, transLogFilePath)
-		err := os.Remove(transLogFilePath)
+		start := time.Now()
+		entries, err := restoreTransLogData(lsm, transLogFilePath)
+		if err != nil {
+			unlockDirector(lockFile)
+			return nil, err
+		}
+		lsm.logger.Info("transLog recovered", "director", director, "entries", entries, "duration", time.Since(start))
+		err = os.Remove(transLogFilePath)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -418,30 +846,19 @@ func NewLsm(director string, transLogStrictSync bool) (*Lsm, error) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	_, err = transLogFile.WriteString(transLogHeader)
+	if err != nil {
+		log.Fatal(err)
+	}
 	lsm.transLogFile = transLogFile
 
 	// 如果没有开启严格的同步模式，则需要异步的transLog数据同步
 	if !lsm.transLogStrictSync {
-		go func() {
-			ticker := time.NewTicker(time.Second * transLogAsyncInterval)
-			for range ticker.C {
-				if lsm.closed {
-					return
-				}
-				// 每隔指定时间把日志数据落盘
-				err = lsm.transLogFile.Sync()
-				if err != nil {
-					// 在LSM被关闭时，日志文件会被关闭，此时退出异步数据落盘协程
-					if err.Error() == "sync "+lsm.transLogFile.Name()+": file already closed" {
-						log.Println("Async transLog synchronize goroutine closed.")
-						return
-					}
-					log.Fatal(err)
-				}
-			}
-		}()
+		lsm.background.Add(1)
+		go lsm.syncTransLogPeriodically()
 	}
 
+	lsm.background.Add(1)
 	go lsm.backgroundMerge()
 	return lsm, nil
 }
@@ -1,136 +1,313 @@
 package lsm
 
 import (
+	"context"
+	"github.com/ryszard/goskiplist/skiplist"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"path"
 	"strings"
+	"sync"
+	"time"
 )
 
-// 用于只读数据
+// 用于只读数据，可以和写入数据的进程同时使用。
+// Reader读取的是最近一次刷新时清单中记录的段文件，调用Refresh或者配置RefreshInterval之后才能看到新写入的数据；
+// 正在读取的段文件会被固定，在Reader刷新或者关闭之前不会被合并操作删除，使用完毕之后需要调用Close
 type Reader struct {
-	path string
+	path          string
+	blockCache    *BlockCache   // 数据块缓存
+	mergeOperator MergeOperator // 合并操作符
+	comparator    Comparator    // key的比较器
+	tailTransLog  bool          // 是否读取transLog中还没有同步到段文件的数据
+
+	mutex           sync.RWMutex
+	manifestVersion uint64             // 当前读取的清单版本，为0表示目录中没有可用的清单
+	segments        []string           // 当前读取的段文件对应的索引文件
+	memTable        *skiplist.SkipList // 从transLog中读取的数据
+	transLogSize    int64              // 最近一次刷新时transLog的大小
+	pinFilePath     string             // 固定段文件的标记文件
+	pinned          bool               // 标记文件是否写入成功，没有写入时段文件只受写入进程删除前的等待时间保护
+	logger          Logger
+	done            chan bool
+	closed          bool
 }
 
 func (r *Reader) Get(key string) (string, bool) {
-	ok := false
-	valueTimestamp := uint64(0) // 当前值的时间
-	value := ""                 // 最大时间对于的值
-
-	// 根据得到的data来决定是否更新最终value的值
-	var setValue = func(data Data) {
-		if data.timestamp > valueTimestamp {
-			value = data.value              // 更新值的内容
-			ok = true                       // 已经找到了对应的值
-			valueTimestamp = data.timestamp // 更新该值对应的时间戳
-		}
+	return r.read(key, math.MaxUint64, uint64(time.Now().UnixNano()))
+}
+
+// 通过key获取值，ctx被取消时返回ctx.Err()，需要合并操作数但是没有配置合并操作符时返回ErrNoMergeOperator，
+// Reader已经关闭时返回ErrClosed
+func (r *Reader) GetContext(ctx context.Context, key string) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.closed {
+		return "", false, ErrClosed
 	}
+	v := r.view()
+	v.ctx = ctx
+	return v.get(key, math.MaxUint64, uint64(time.Now().UnixNano()))
+}
 
-	indexFilesPath := getIndexFilesPath(r.path)
-	// 根据所有的索引文件，去对应的段文件中检索数据
-	for _, indexFilePath := range indexFilesPath {
-		segFilePath := strings.Replace(indexFilePath, indexFileSuffix, segmentFileSuffix, -1)
-		if _, err := os.Stat(strings.Replace(indexFilePath, indexFileSuffix, unavailableFileSuffix, -1)); !os.IsNotExist(err) {
-			// 如果当前段文件存在对应的ua文件，则跳过此文件
-			continue
-		}
+// 查找key在时间戳timestamp时的值，合并操作数会被合并到旧值上，now用于判断数据是否过期
+func (r *Reader) read(key string, timestamp uint64, now uint64) (string, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	value, ok, _ := r.view().get(key, timestamp, now)
+	return value, ok
+}
 
-		var err error
-		indexData, err := ioutil.ReadFile(indexFilePath)
-		if err != nil {
-			log.Fatal(err)
+// key当前是否存在
+func (r *Reader) Has(key string) bool {
+	_, ok := r.Get(key)
+	return ok
+}
+
+// 获取一组key的值，返回的值以及是否存在的标记和keys的顺序一致
+func (r *Reader) MultiGet(keys []string) ([]string, []bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	values, found, _ := r.view().multiGet(keys, math.MaxUint64, uint64(time.Now().UnixNano()))
+	return values, found
+}
+
+// 创建一个遍历最近一次刷新时数据的迭代器，迭代器不受之后的刷新影响，使用完毕之后需要调用Close
+func (r *Reader) NewIterator() *Iterator {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	iter := r.view().newIterator(uint64(time.Now().UnixNano()))
+	if r.closed {
+		iter.err = ErrClosed
+	}
+	return iter
+}
+
+// 按照比较器的顺序访问[start, end)范围内当前存在的key，start为空表示从第一个key开始，end为空表示没有上界，
+// visit返回false时停止遍历
+func (r *Reader) Scan(start string, end string, visit func(key string, value string) bool) {
+	scan(r.NewIterator(), r.comparator, start, end, visit)
+}
+
+// 重新读取清单以及transLog，之后的读取可以看到刷新之前写入的数据
+func (r *Reader) Refresh() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.closed {
+		r.refresh()
+	}
+}
+
+func (r *Reader) refresh() {
+	// 写入进程总是先把数据写入段文件并更新清单，然后再清空transLog，
+	// 因此先读取transLog再读取清单可以保证不会遗漏数据
+	memTable, transLogSize := newMemTable(r.comparator), int64(0)
+	if r.tailTransLog {
+		memTable, transLogSize = r.readTransLog()
+	}
+	version, segments := currentSegments(r.path)
+	// 写入进程在段文件从清单中移除之后还会等待一段时间才删除它，因此可以在这段时间内固定读取到的段文件；
+	// 固定是尽力而为的，目录只读时Reader仍然可以读取，只是段文件在等待时间结束之后可能被删除
+	if err := writePinFile(r.pinFilePath, segments); err != nil {
+		if r.pinned {
+			// 旧的标记文件固定的段文件已经不再被读取
+			os.Remove(r.pinFilePath)
 		}
+		r.pinned = false
+		r.logger.Warn("segments not pinned", "director", r.path, "error", err)
+	} else {
+		r.pinned = true
+	}
+	r.manifestVersion = version
+	r.segments = segments
+	r.memTable = memTable
+	r.transLogSize = transLogSize
+}
 
-		indices := getIndexList(indexData)
-		length := len(indices)
-		offsetLeft := uint32(0)  // 可检索范围内的最小索引下标
-		offsetRight := uint32(0) // 可检索范围内的最大索引下标
-		// 0或1个索引是没有意义的
-		if length > 1 {
-			// 超过范围，无法被找到，跳过该索引文件
-			if key < indices[0].key || key > indices[length-1].key {
-				continue
-			}
-			for i := 0; i < length; i++ {
-				// 直接命中索引
-				if indices[i].key == key {
-					offsetLeft = indices[i].offset
-					offsetRight = offsetLeft
-					break
-				}
-				// 最后一个元素都没有命中，索引命中失败，需要全文检索
-				if i == length-1 {
-					break
-				}
-				// 索引范围命中，确定值应在指定的范围之中
-				if indices[i].key < key && key < indices[i+1].key {
-					offsetLeft = indices[i].offset
-					offsetRight = indices[i+1].offset
-					break
-				}
+// 读取transLog中默认列族的数据
+func (r *Reader) readTransLog() (*skiplist.SkipList, int64) {
+	memTable := newMemTable(r.comparator)
+	logData, err := ioutil.ReadFile(path.Join(r.path, transLog))
+	if os.IsNotExist(err) {
+		return memTable, 0
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	// 写入进程可能正在追加最后一个条目，只读取完整的条目
+	entries, _, _ := decodeTransLog(logData)
+	for _, records := range entries {
+		for _, rec := range records {
+			if rec.family == defaultColumnFamily {
+				memTable.Set(internalKey{rec.key, rec.data.timestamp}, rec.data)
 			}
 		}
+	}
+	return memTable, int64(len(logData))
+}
 
-		segFile, err := os.Open(segFilePath)
-		if err != nil {
-			log.Fatal(err)
+// 获取目录中当前可用的段文件，清单不存在或者清单中的段文件已经被删除时直接扫描目录
+func currentSegments(director string) (uint64, []string) {
+	version, segments, ok := readManifest(director)
+	if ok {
+		indexFilesPath := make([]string, 0, len(segments))
+		for _, segment := range segments {
+			indexFilePath := path.Join(director, strings.Replace(segment, segmentFileSuffix, indexFileSuffix, -1))
+			if _, err := os.Stat(indexFilePath); err != nil {
+				ok = false
+				break
+			}
+			indexFilesPath = append(indexFilesPath, indexFilePath)
 		}
-		size := getFileSize(segFile)
-
-		if offsetLeft == 0 && offsetRight == 0 {
-			// 1. 索引失效
-			for {
-				thisKey, data := readKeyAndData(segFile)
-				if thisKey == key { // 取到对应的值
-					setValue(data)
-					break
-				}
+		if ok {
+			return version, indexFilesPath
+		}
+	}
+	return 0, getAvailableIndexFilesPath(director)
+}
 
-				position := getCurrentPosition(segFile)
-				if position == size {
-					// 最终也没能找到对应的值
-					break
-				}
-			}
-		} else if offsetLeft == offsetRight {
-			// 2. 索引精确命中
-			setCurrentPosition(segFile, offsetLeft)
-			_, data := readKeyAndData(segFile)
-			setValue(data)
-		} else if offsetLeft < offsetRight {
-			// 3. 索引范围命中
-			setCurrentPosition(segFile, offsetLeft) // 从左开始查找
-
-			for {
-				thisKey, data := readKeyAndData(segFile)
-				if thisKey == key {
-					setValue(data)
-					break
-				}
+// 目录中的数据在最近一次刷新之后是否发生过变化，为true时调用Refresh可以读取到最新的数据
+func (r *Reader) Stale() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	version, segments := currentSegments(r.path)
+	if version != r.manifestVersion || len(segments) != len(r.segments) {
+		return true
+	}
+	for i := range segments {
+		if segments[i] != r.segments[i] {
+			return true
+		}
+	}
+	if r.tailTransLog {
+		info, err := os.Stat(path.Join(r.path, transLog))
+		if err == nil && info.Size() != r.transLogSize {
+			return true
+		}
+	}
+	return false
+}
 
-				position := getCurrentPosition(segFile)
-				if uint32(position) >= offsetRight {
-					break
+// 后台续期标记文件，如果配置了刷新间隔则定时刷新
+func (r *Reader) background(refreshInterval time.Duration) {
+	renew := time.NewTicker(time.Second * pinLeaseTime / 3)
+	defer renew.Stop()
+	var refresh <-chan time.Time
+	if refreshInterval > 0 {
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-refresh:
+			r.Refresh()
+		case <-renew.C:
+			r.mutex.Lock()
+			if !r.closed && r.pinned {
+				now := time.Now()
+				err := os.Chtimes(r.pinFilePath, now, now)
+				if err != nil {
+					r.logger.Warn("pin file not renewed", "path", r.pinFilePath, "error", err)
 				}
 			}
+			r.mutex.Unlock()
 		}
+	}
+}
 
-		err = segFile.Close()
-		if err != nil {
-			log.Fatal(err)
-		}
+// 关闭Reader，解除对段文件的固定
+func (r *Reader) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.done)
+	if r.pinned {
+		os.Remove(r.pinFilePath)
 	}
-	return value, ok
 }
 
+// 获取段文件的压缩统计信息
+func (r *Reader) CompressionStats() CompressionStats {
+	r.mutex.RLock()
+	segments := r.segments
+	r.mutex.RUnlock()
+	return getCompressionStats(segments)
+}
+
+// 获取最近一次刷新时数据的统计信息
+func (r *Reader) Stats() Stats {
+	r.mutex.RLock()
+	stats, segments := r.view().stats(), r.segments
+	stats.TransLogBytes = r.transLogSize
+	r.mutex.RUnlock()
+	stats.Compression = getCompressionStats(segments)
+	return stats
+}
+
+// Reader使用的比较器，它和写入数据时使用的比较器一致
+func (r *Reader) Comparator() Comparator {
+	return r.comparator
+}
+
+// 获取数据块缓存的统计信息
+func (r *Reader) BlockCacheStats() CacheStats {
+	return r.blockCache.Stats()
+}
+
+// 新建一个只读的LSM，无法打开时进程会退出，需要处理错误时使用NewLsmReaderWithOptions
 func NewLsmReader(director string) *Reader {
+	reader, err := NewLsmReaderWithOptions(director, Options{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return reader
+}
+
+// 使用指定的配置项新建一个只读的LSM，只有读取相关的配置项会生效。
+// 配置的比较器和目录中保存的比较器不一致时返回ErrComparatorMismatch
+func NewLsmReaderWithOptions(director string, options Options) (*Reader, error) {
 	if director == "" {
 		dir, err := os.Getwd()
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		director = dir
 	}
-	reader := &Reader{path: director}
-	return reader
+	if err := checkFormat(director); err != nil {
+		return nil, err
+	}
+	comparator, err := openComparator(director, options.Comparator, false)
+	if err != nil {
+		return nil, err
+	}
+	reader := &Reader{
+		path:          director,
+		blockCache:    options.BlockCache,
+		mergeOperator: options.MergeOperator,
+		tailTransLog:  options.TailTransLog,
+		comparator:    comparator,
+		pinFilePath:   newPinFilePath(director),
+		done:          make(chan bool),
+		logger:        options.Logger,
+	}
+	if reader.logger == nil {
+		reader.logger = nopLogger{}
+	}
+	if reader.blockCache == nil {
+		reader.blockCache = defaultBlockCache
+	}
+	reader.refresh()
+	go reader.background(options.RefreshInterval)
+	return reader, nil
 }
@@ -1,10 +1,20 @@
 package lsm
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"math"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -157,3 +167,1904 @@ func TestQuery(t *testing.T) {
 
 	lsm.Close()
 }
+
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsmWithOptions(dir, Options{Compression: FlateCompression})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat(`{"tenant":"acme","region":"eu"}`, 4)
+	for i := 0; i < 3000; i++ {
+		lsm.Set(fmt.Sprintf("key%05d", i), value)
+	}
+	lsm.SyncMemTable()
+	for i := 0; i < 2000; i++ {
+		lsm.Set(fmt.Sprintf("key%05d", i*2), fmt.Sprintf("new%d", i))
+	}
+	lsm.SyncMemTable()
+
+	stats := lsm.CompressionStats()
+	if stats.Blocks == 0 || stats.Ratio() >= 0.5 {
+		t.Fatalf("unexpected compression stats %+v", stats)
+	}
+	reader := NewLsmReader(dir)
+	for _, get := range []func(string) (string, bool){lsm.Get, reader.Get} {
+		if v, ok := get("key00001"); !ok || v != value {
+			t.Fatalf("key00001: %s %v", v, ok)
+		}
+		if v, ok := get("key00002"); !ok || v != "new1" {
+			t.Fatalf("key00002: %s %v", v, ok)
+		}
+		if _, ok := get("key99999"); ok {
+			t.Fatal("key99999 should not exist")
+		}
+	}
+
+	// 把两个段文件归并为一个
+	segFile1, _ := os.Open(path.Join(dir, "0"+segmentFileSuffix))
+	segFile2, _ := os.Open(path.Join(dir, "1"+segmentFileSuffix))
+	target := createNewSegFile(dir)
+	merge(segFile1, segFile2, target, FlateCompression, BytewiseComparator, &versionFilter{})
+	closeFile(segFile1)
+	closeFile(segFile2)
+	closeFile(target)
+	for _, name := range []string{"0", "1"} {
+		removeFile(path.Join(dir, name+segmentFileSuffix))
+		removeFile(path.Join(dir, name+indexFileSuffix))
+	}
+	removeFile(strings.Replace(target.Name(), segmentFileSuffix, unavailableFileSuffix, -1))
+	// Reader需要刷新之后才能读取到合并产生的段文件
+	lsm.updateManifest()
+	reader.Refresh()
+	for i := 0; i < 3000; i++ {
+		expected := value
+		if i%2 == 0 {
+			expected = fmt.Sprintf("new%d", i/2)
+		}
+		if v, ok := reader.Get(fmt.Sprintf("key%05d", i)); !ok || v != expected {
+			t.Fatalf("key%05d: %s %v", i, v, ok)
+		}
+	}
+	lsm.Close()
+}
+
+func TestBlockPrefixKeys(t *testing.T) {
+	var builder blockBuilder
+	keys := make([]string, 0)
+	plainSize := 0 // 不进行前缀压缩时的大小
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("tenant/region/entity/%03d", i*2)
+		keys = append(keys, key)
+		builder.add(key, Data{value: "v" + key, timestamp: uint64(i)})
+		plainSize += len(encodeKeyAndData(key, Data{value: "v" + key}))
+	}
+	raw := builder.finish()
+	if len(raw) > plainSize*3/4 {
+		t.Fatalf("block is not prefix compressed: %d bytes", len(raw))
+	}
+
+	iter := newBlockIterator(raw)
+	if len(iter.restarts) != (100+blockRestartInterval-1)/blockRestartInterval {
+		t.Fatalf("unexpected restarts %v", iter.restarts)
+	}
+	for i, key := range keys {
+		if !iter.seek(BytewiseComparator, key) || iter.key != key || iter.data.value != "v"+key || iter.data.timestamp != uint64(i) {
+			t.Fatalf("seek %s: %s %+v", key, iter.key, iter.data)
+		}
+		// 不存在的key定位到下一个key
+		missing := fmt.Sprintf("tenant/region/entity/%03d", i*2+1)
+		found := iter.seek(BytewiseComparator, missing)
+		if i+1 < len(keys) && (!found || iter.key != keys[i+1]) {
+			t.Fatalf("seek %s: %s", missing, iter.key)
+		}
+		if i+1 == len(keys) && found {
+			t.Fatalf("seek %s should fail", missing)
+		}
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewBlockCache(blockSize * 4)
+	lsm, err := NewLsmWithOptions(dir, Options{BlockCache: cache})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i++ {
+		lsm.Set(fmt.Sprintf("key%05d", i), randomString(10))
+	}
+	lsm.SyncMemTable()
+
+	reader, _ := NewLsmReaderWithOptions(dir, Options{BlockCache: cache})
+	lsm.Get("key00010")
+	reader.Get("key00010")
+	reader.Get("key00011")
+	stats := cache.Stats()
+	if stats.Misses != 1 || stats.Hits != 2 || stats.Entries != 1 {
+		t.Fatalf("unexpected cache stats %+v", stats)
+	}
+
+	// 超出容量后淘汰最久没有被使用的数据块
+	for i := 0; i < 3000; i += 100 {
+		reader.Get(fmt.Sprintf("key%05d", i))
+	}
+	stats = reader.BlockCacheStats()
+	if stats.Size > stats.Capacity || stats.Entries == 0 {
+		t.Fatalf("unexpected cache stats %+v", stats)
+	}
+	lsm.Close()
+}
+
+func TestRowCache(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsmWithOptions(dir, Options{RowCacheSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsm.Set("name", "Mike")
+	lsm.Set("age", "18")
+	lsm.SyncMemTable()
+	for i := 0; i < 3; i++ {
+		if v, ok := lsm.Get("name"); !ok || v != "Mike" {
+			t.Fatalf("name: %s %v", v, ok)
+		}
+	}
+	if stats := lsm.RowCacheStats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Fatalf("unexpected cache stats %+v", stats)
+	}
+
+	// 写入和删除后缓存失效
+	lsm.Set("name", "Json")
+	lsm.Delete("age")
+	if _, ok := lsm.Get("age"); ok {
+		t.Fatal("age should be deleted")
+	}
+	lsm.SyncMemTable()
+	if v, ok := lsm.Get("name"); !ok || v != "Json" {
+		t.Fatalf("name: %s %v", v, ok)
+	}
+	for _, get := range []func(string) (string, bool){lsm.Get, lsm.Get, NewLsmReader(dir).Get} {
+		if v, ok := get("age"); ok {
+			t.Fatalf("age should be deleted: %s", v)
+		}
+	}
+	lsm.Close()
+}
+
+// 遍历迭代器中的所有数据
+func iterate(iter *Iterator) map[string]string {
+	defer iter.Close()
+	result := make(map[string]string)
+	started, prev := false, ""
+	for iter.Next() {
+		if started && iter.iter.comparator.Compare(iter.Key(), prev) <= 0 {
+			panic(fmt.Sprintf("iterator is not ordered: %q %q", prev, iter.Key()))
+		}
+		started, prev = true, iter.Key()
+		result[iter.Key()] = iter.Value()
+	}
+	return result
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsm.Set("a", "1")
+	lsm.Set("b", "1")
+	lsm.SyncMemTable()
+	lsm.Set("a", "2")
+	snapshot := lsm.NewSnapshot()
+	lsm.Set("a", "3")
+	lsm.Delete("b")
+	lsm.Set("c", "3")
+
+	check := func() {
+		if v, ok := snapshot.Get("a"); !ok || v != "2" {
+			t.Fatalf("snapshot a: %s %v", v, ok)
+		}
+		if v, ok := snapshot.Get("b"); !ok || v != "1" {
+			t.Fatalf("snapshot b: %s %v", v, ok)
+		}
+		if v, ok := snapshot.Get("c"); ok {
+			t.Fatalf("snapshot c: %s", v)
+		}
+		if v, ok := lsm.Get("a"); !ok || v != "3" {
+			t.Fatalf("a: %s %v", v, ok)
+		}
+		if result := iterate(snapshot.NewIterator()); fmt.Sprint(result) != "map[a:2 b:1]" {
+			t.Fatalf("snapshot iterator: %v", result)
+		}
+		if result := iterate(lsm.NewIterator()); fmt.Sprint(result) != "map[a:3 c:3]" {
+			t.Fatalf("iterator: %v", result)
+		}
+	}
+	check()
+	// 刷盘以及合并之后快照仍然可以读取到旧版本
+	lsm.SyncMemTable()
+	check()
+	segFile1, _ := os.Open(path.Join(dir, "0"+segmentFileSuffix))
+	segFile2, _ := os.Open(path.Join(dir, "1"+segmentFileSuffix))
+	target := createNewSegFile(dir)
+	merge(segFile1, segFile2, target, NoCompression, BytewiseComparator, lsm.newVersionFilter())
+	for _, file := range []*os.File{segFile1, segFile2, target} {
+		closeFile(file)
+	}
+	for _, name := range []string{"0", "1"} {
+		removeFile(path.Join(dir, name+segmentFileSuffix))
+		removeFile(path.Join(dir, name+indexFileSuffix))
+	}
+	removeFile(strings.Replace(target.Name(), segmentFileSuffix, unavailableFileSuffix, -1))
+	check()
+
+	// 快照释放之后旧版本在刷盘时被清理
+	snapshot.Release()
+	lsm.Set("a", "4")
+	lsm.Set("a", "5")
+	if lsm.memTable.Len() != 1 {
+		t.Fatalf("memTable should only keep the newest version, got %d", lsm.memTable.Len())
+	}
+	lsm.Close()
+}
+
+func TestTxn(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsm.Set("counter", "0")
+
+	// 多个协程并发地对计数器进行读-改-写
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for j := 0; j < 25; j++ {
+				for {
+					txn := lsm.BeginTxn()
+					value, _ := txn.Get("counter")
+					var counter int
+					fmt.Sscan(value, &counter)
+					txn.Set("counter", fmt.Sprint(counter+1))
+					txn.Set(fmt.Sprintf("log%d", counter), "x")
+					err := txn.Commit()
+					if err == nil {
+						break
+					}
+					if err != ErrConflict {
+						panic(err)
+					}
+				}
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+	if v, _ := lsm.Get("counter"); v != "100" {
+		t.Fatalf("counter: %s", v)
+	}
+
+	txn := lsm.BeginTxn()
+	txn.Delete("counter")
+	if _, ok := txn.Get("counter"); ok {
+		t.Fatal("counter should be deleted in transaction")
+	}
+	txn.Rollback()
+	if err := txn.Commit(); err != ErrTxnDone {
+		t.Fatal(err)
+	}
+	if v, _ := lsm.Get("counter"); v != "100" {
+		t.Fatalf("counter: %s", v)
+	}
+	lsm.Close()
+}
+
+func TestTransLogRecovery(t *testing.T) {
+	dir := t.TempDir()
+	entry := encodeTransLogEntry([]record{{"a", Data{value: "1", timestamp: 1}, defaultColumnFamily}, {"b", Data{value: "2", timestamp: 1}, defaultColumnFamily}})
+	torn := encodeTransLogEntry([]record{{"c", Data{value: "3", timestamp: 2}, defaultColumnFamily}, {"d", Data{value: "4", timestamp: 2}, defaultColumnFamily}})
+	logData := append([]byte(transLogHeader), entry...)
+	err := ioutil.WriteFile(path.Join(dir, transLog), append(logData, torn[:len(torn)-3]...), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsm, err := NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := iterate(lsm.NewIterator()); fmt.Sprint(result) != "map[a:1 b:2]" {
+		t.Fatalf("recovered: %v", result)
+	}
+	lsm.Close()
+
+	// 中间的条目损坏时不能丢弃整个transLog
+	dir = t.TempDir()
+	corrupt := append([]byte(transLogHeader), torn...)
+	corrupt[len(transLogHeader)+10] ^= 0xff
+	ioutil.WriteFile(path.Join(dir, transLog), append(corrupt, entry...), 0666)
+	if _, err := NewLsm(dir, false); !errors.Is(err, ErrCorruptTransLog) {
+		t.Fatal("corrupt transLog should be reported", err)
+	}
+	if _, err := os.Stat(path.Join(dir, transLog)); err != nil {
+		t.Fatal("corrupt transLog should be kept", err)
+	}
+
+	// 最初格式的transLog没有文件头部，其中的记录属于默认列族
+	dir = t.TempDir()
+	var legacy []byte
+	for _, key := range []string{"x", "y"} {
+		legacy = append(legacy, addBufHead([]byte(key))...)
+		legacy = append(legacy, addBufHead([]byte("v"+key))...)
+		legacy = append(legacy, uint64ToBytes(3)...)
+	}
+	ioutil.WriteFile(path.Join(dir, transLog), legacy, 0666)
+	lsm, err = NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := iterate(lsm.NewIterator()); fmt.Sprint(result) != "map[x:vx y:vy]" {
+		t.Fatalf("recovered legacy transLog: %v", result)
+	}
+	lsm.Close()
+}
+
+func TestVersions(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsmWithOptions(dir, Options{MaxVersions: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	times := make([]time.Time, 0)
+	for i := 1; i <= 5; i++ {
+		lsm.Set("config", fmt.Sprintf("v%d", i))
+		times = append(times, time.Now())
+		if i == 2 {
+			lsm.SyncMemTable()
+		}
+	}
+	lsm.Delete("config")
+
+	check := func(history []Version, length int) {
+		if len(history) != length || !history[0].Deleted || history[1].Value != "v5" || history[2].Value != "v4" {
+			t.Fatalf("unexpected history %+v", history)
+		}
+	}
+	// 第一个段文件中的v1和v2还没有被合并，v3在memTable中被清理
+	check(lsm.History("config"), 5)
+	if v, ok := lsm.GetAt("config", times[3]); !ok || v != "v4" {
+		t.Fatalf("config at v4: %s %v", v, ok)
+	}
+	if _, ok := lsm.Get("config"); ok {
+		t.Fatal("config should be deleted")
+	}
+
+	lsm.SyncMemTable()
+	reader := NewLsmReader(dir)
+	check(reader.History("config"), 5)
+	segFile1, _ := os.Open(path.Join(dir, "0"+segmentFileSuffix))
+	segFile2, _ := os.Open(path.Join(dir, "1"+segmentFileSuffix))
+	target := createNewSegFile(dir)
+	merge(segFile1, segFile2, target, NoCompression, BytewiseComparator, lsm.newVersionFilter())
+	for _, file := range []*os.File{segFile1, segFile2, target} {
+		closeFile(file)
+	}
+	for _, name := range []string{"0", "1"} {
+		removeFile(path.Join(dir, name+segmentFileSuffix))
+		removeFile(path.Join(dir, name+indexFileSuffix))
+	}
+	removeFile(strings.Replace(target.Name(), segmentFileSuffix, unavailableFileSuffix, -1))
+	lsm.updateManifest()
+	reader.Refresh()
+	check(reader.History("config"), 3)
+	if v, ok := reader.GetAt("config", times[4]); !ok || v != "v5" {
+		t.Fatalf("config at v5: %s %v", v, ok)
+	}
+	if _, ok := reader.GetAt("config", times[0]); ok {
+		t.Fatal("v1 should have been dropped by merge")
+	}
+	lsm.Close()
+
+	// 同时配置两个限制时，旧版本是最新的两个版本之一或者在保留时长之内写入就会被保留
+	filter := &versionFilter{maxVersions: 2, minTimestamp: 25, versioned: true}
+	kept := make([]bool, 0)
+	for _, timestamp := range []uint64{50, 40, 30, 20, 10} {
+		kept = append(kept, filter.keep("config", timestamp))
+	}
+	if fmt.Sprint(kept) != "[true true true false false]" {
+		t.Fatalf("unexpected kept versions %v", kept)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsmWithOptions(dir, Options{RowCacheSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsm.Set("user", "Mike")
+	lsm.Set("token", "old")
+	lsm.SyncMemTable()
+	lsm.SetWithTTL("session", "abc", time.Millisecond*50)
+	lsm.SetWithTTL("token", "new", time.Millisecond*50)
+	lsm.SyncMemTable()
+	if v, ok := lsm.Get("token"); !ok || v != "new" {
+		t.Fatalf("token: %s %v", v, ok)
+	}
+	if result := iterate(lsm.NewIterator()); len(result) != 3 {
+		t.Fatalf("iterator: %v", result)
+	}
+
+	time.Sleep(time.Millisecond * 60)
+	// 过期的数据不可见，并且不会让旧版本重新出现
+	for _, get := range []func(string) (string, bool){lsm.Get, NewLsmReader(dir).Get} {
+		if v, ok := get("session"); ok {
+			t.Fatalf("session should be expired: %s", v)
+		}
+		if v, ok := get("token"); ok {
+			t.Fatalf("token should be expired: %s", v)
+		}
+	}
+	if result := iterate(lsm.NewIterator()); fmt.Sprint(result) != "map[user:Mike]" {
+		t.Fatalf("iterator: %v", result)
+	}
+
+	// 合并时过期数据的值被清理
+	segFile1, _ := os.Open(path.Join(dir, "0"+segmentFileSuffix))
+	segFile2, _ := os.Open(path.Join(dir, "1"+segmentFileSuffix))
+	target := createNewSegFile(dir)
+	merge(segFile1, segFile2, target, NoCompression, BytewiseComparator, lsm.newVersionFilter())
+	for _, file := range []*os.File{segFile1, segFile2, target} {
+		closeFile(file)
+	}
+	data, _ := searchSegment(NewBlockCache(0), BytewiseComparator, strings.Replace(target.Name(), segmentFileSuffix, indexFileSuffix, -1), "session", math.MaxUint64)
+	if data.kind != typeDeletion || data.value != "" {
+		t.Fatalf("expired session should be dropped: %+v", data)
+	}
+	lsm.Close()
+
+	// 合并所有段文件时过期的数据以及删除标记都会被彻底清理
+	dir = t.TempDir()
+	lsm, err = NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		lsm.SetWithTTL(fmt.Sprintf("session:%d", i), "abc", time.Millisecond*10)
+	}
+	lsm.Set("user", "Mike")
+	lsm.Set("token", "old")
+	lsm.SyncMemTable()
+	lsm.Delete("token")
+	lsm.SyncMemTable()
+	time.Sleep(time.Millisecond * 20)
+	if err := lsm.CompactRange("", ""); err != nil {
+		t.Fatal(err)
+	}
+	expireObsoleteSegments(lsm.ColumnFamily)
+	lsm.Close()
+	if report, err := Verify(dir); err != nil || report.Records != 1 {
+		t.Fatalf("only user should remain on disk: %+v %v", report, err)
+	}
+}
+
+func TestCompareAndSet(t *testing.T) {
+	lsm, err := NewLsm(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 多个协程竞争同一个锁，只有一个可以成功
+	winners := make(chan int, 8)
+	done := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			if ok, _ := lsm.SetIfAbsent("lock", fmt.Sprint(i)); ok {
+				winners <- i
+			}
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+	if len(winners) != 1 {
+		t.Fatalf("%d goroutines acquired the lock", len(winners))
+	}
+	owner := fmt.Sprint(<-winners)
+	lsm.SyncMemTable()
+
+	cas := func(ok bool, err error) bool {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	if cas(lsm.CompareAndSet("lock", "nobody", "x")) || cas(lsm.DeleteIfEquals("lock", "nobody")) {
+		t.Fatal("conditional write should fail")
+	}
+	if !cas(lsm.CompareAndSet("lock", owner, "renewed")) {
+		t.Fatal("CompareAndSet should succeed")
+	}
+	if !cas(lsm.DeleteIfEquals("lock", "renewed")) {
+		t.Fatal("DeleteIfEquals should succeed")
+	}
+	if cas(lsm.CompareAndSet("lock", "renewed", "x")) || !cas(lsm.SetIfAbsent("lock", "again")) {
+		t.Fatal("lock should be released")
+	}
+	lsm.Close()
+}
+
+func TestMergeOperator(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lsm.Merge("counter", "1") != ErrNoMergeOperator {
+		t.Fatal("Merge without operator should fail")
+	}
+	lsm.Close()
+
+	lsm, err = NewLsmWithOptions(dir, Options{MergeOperator: Int64AddOperator{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		lsm.Merge("counter", "1")
+	}
+	lsm.Set("base", "100")
+	lsm.SyncMemTable()
+	snapshot := lsm.NewSnapshot()
+	for i := 0; i < 5; i++ {
+		lsm.Merge("counter", "2")
+		lsm.Merge("base", "-1")
+	}
+	lsm.SyncMemTable()
+	lsm.Delete("base")
+	lsm.Merge("base", "7")
+
+	check := func(key string, expected string) {
+		if value, ok := lsm.Get(key); !ok || value != expected {
+			t.Fatalf("%s: expected %s, got %s %v", key, expected, value, ok)
+		}
+	}
+	check("counter", "20")
+	check("base", "7")
+	if value, _ := snapshot.Get("counter"); value != "10" {
+		t.Fatalf("snapshot should see 10, got %s", value)
+	}
+	if values := iterate(lsm.NewIterator()); values["counter"] != "20" || values["base"] != "7" {
+		t.Fatalf("unexpected iterator values %v", values)
+	}
+	snapshot.Release()
+
+	// 合并段文件之后操作数被合并为一个普通的值
+	lsm.SyncMemTable()
+	mergeSegments(lsm.ColumnFamily)
+	// 段文件中没有旧值的操作数只能合并为一个操作数
+	if history := lsm.History("counter"); len(history) != 1 || !history[0].Merge || history[0].Value != "20" {
+		t.Fatalf("operands should be collapsed, got %v", history)
+	}
+	if history := lsm.History("base"); len(history) != 1 || history[0].Merge || history[0].Value != "7" {
+		t.Fatalf("operands should be merged into the base value, got %v", history)
+	}
+	check("base", "7")
+	lsm.Close()
+
+	reader, _ := NewLsmReaderWithOptions(dir, Options{MergeOperator: Int64AddOperator{}})
+	if value, _ := reader.Get("counter"); value != "20" {
+		t.Fatalf("reader should see 20, got %s", value)
+	}
+	reader.Close()
+
+	// 没有配置合并操作符时读取操作数返回错误
+	reader, _ = NewLsmReaderWithOptions(dir, Options{})
+	if _, _, err := reader.GetContext(context.Background(), "counter"); err != ErrNoMergeOperator {
+		t.Fatal("reader should report missing merge operator", err)
+	}
+	reader.Close()
+	if _, _, err := reader.GetContext(context.Background(), "counter"); err != ErrClosed {
+		t.Fatal("reader should return ErrClosed after close", err)
+	}
+	lsm, err = NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := lsm.GetContext(context.Background(), "counter"); err != ErrNoMergeOperator {
+		t.Fatal("get should report missing merge operator", err)
+	}
+	if value, ok := lsm.Get("base"); !ok || value != "7" {
+		t.Fatal("merged value should be readable without operator", value)
+	}
+	iter := lsm.NewIterator()
+	for iter.Next() {
+	}
+	if iter.Err() != ErrNoMergeOperator {
+		t.Fatal("iterator should report missing merge operator", iter.Err())
+	}
+	iter.Close()
+	lsm.Close()
+
+	// 后台合并跳过中间的段文件时，操作数不能越过中间段文件中更新的值合并到更旧的版本上
+	dir = t.TempDir()
+	lsm, err = NewLsmWithOptions(dir, Options{MergeOperator: Int64AddOperator{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsm.Set("c", "10")
+	lsm.Merge("d", "2")
+	lsm.SyncMemTable()
+	lsm.Set("c", "100")
+	lsm.Set("d", "100")
+	lsm.SyncMemTable()
+	lsm.Merge("c", "1")
+	lsm.Merge("d", "1")
+	lsm.SyncMemTable()
+	lsm.compactionMutex.Lock()
+	_, err = lsm.mergeTwoSegments(path.Join(dir, "0"+segmentFileSuffix), path.Join(dir, "2"+segmentFileSuffix))
+	lsm.compactionMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("c", "101")
+	check("d", "101")
+	lsm.Close()
+
+	appender := StringAppendOperator{Separator: ","}
+	if value := appender.FullMerge("k", "a", true, []string{"b", "c"}); value != "a,b,c" {
+		t.Fatalf("unexpected append result %s", value)
+	}
+	if value, _ := appender.PartialMerge("k", "b", "c"); value != "b,c" {
+		t.Fatalf("unexpected append result %s", value)
+	}
+}
+
+func TestColumnFamily(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"../users", transLog, metadataFile, manifestFile} {
+		if _, err := lsm.OpenColumnFamily(name, Options{}); err != ErrInvalidColumnFamily {
+			t.Fatal("invalid column family name should be rejected", name)
+		}
+	}
+	users, _ := lsm.OpenColumnFamily("users", Options{Compression: FlateCompression})
+	metrics, _ := lsm.OpenColumnFamily("metrics", Options{MergeOperator: Int64AddOperator{}})
+
+	lsm.Set("a", "default")
+	users.Set("a", "user")
+	if metrics.Merge("a", "1") != nil || lsm.Merge("a", "1") != ErrNoMergeOperator {
+		t.Fatal("merge operator should be configured per column family")
+	}
+	if _, ok := metrics.Get("b"); ok {
+		t.Fatal("column families should not share keys")
+	}
+
+	// 跨列族的批量写入原子地对快照可见
+	snapshot := lsm.NewSnapshot()
+	batch := NewBatch()
+	batch.Set(users, "b", "2")
+	batch.Delete(lsm.ColumnFamily, "a")
+	batch.Merge(metrics, "a", "2")
+	if err := lsm.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewLsm(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherUsers, _ := other.OpenColumnFamily("users", Options{})
+	unknown := NewBatch()
+	unknown.Set(otherUsers, "c", "3")
+	if err := lsm.Write(unknown); err != ErrUnknownColumnFamily {
+		t.Fatal("column family of another lsm should be rejected", err)
+	}
+	unknown = NewBatch()
+	unknown.Set(users, "c", "3")
+	if err := other.Write(unknown); err != ErrUnknownColumnFamily {
+		t.Fatal("column family of another lsm should be rejected", err)
+	}
+	other.Close()
+	if _, ok := snapshot.GetCF(users, "b"); ok {
+		t.Fatal("snapshot should not see the batch")
+	}
+	if value, _ := snapshot.GetCF(metrics, "a"); value != "1" {
+		t.Fatalf("snapshot should see 1, got %s", value)
+	}
+	snapshot.Release()
+	check := func(cf *ColumnFamily, expected string) {
+		if result := fmt.Sprint(iterate(cf.NewIterator())); result != expected {
+			t.Fatalf("%s: expected %s, got %s", cf.Name(), expected, result)
+		}
+	}
+	check(lsm.ColumnFamily, "map[]")
+	check(users, "map[a:user b:2]")
+	check(metrics, "map[a:3]")
+
+	// 所有列族共享同一个transLog，未同步的数据在重新打开后被恢复到各自的列族中
+	lsm.Set("c", "3")
+	crash(lsm)
+	lsm, err = NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, _ = lsm.OpenColumnFamily("users", Options{})
+	metrics, _ = lsm.OpenColumnFamily("metrics", Options{MergeOperator: Int64AddOperator{}})
+	check(lsm.ColumnFamily, "map[c:3]")
+	check(users, "map[a:user b:2]")
+	check(metrics, "map[a:3]")
+	lsm.Close()
+
+	if value, _ := NewLsmReader(path.Join(dir, "users")).Get("b"); value != "2" {
+		t.Fatalf("reader should see 2, got %s", value)
+	}
+}
+
+// 按照整数大小比较key的比较器
+type numericComparator struct{}
+
+func (numericComparator) Name() string {
+	return "test.NumericComparator"
+}
+
+func (numericComparator) Compare(a, b string) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
+func TestComparator(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsmWithOptions(dir, Options{Comparator: numericComparator{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"100", "9", "25"} {
+		lsm.Set(key, "v"+key)
+	}
+	lsm.SyncMemTable()
+	for _, key := range []string{"3", "1000", "25"} {
+		lsm.Set(key, "w"+key)
+	}
+	lsm.SyncMemTable()
+	keys := func() string {
+		iter := lsm.NewIterator()
+		defer iter.Close()
+		result := make([]string, 0)
+		for iter.Next() {
+			result = append(result, iter.Key()+"="+iter.Value())
+		}
+		return strings.Join(result, " ")
+	}
+	if result := keys(); result != "3=w3 9=v9 25=w25 100=v100 1000=w1000" {
+		t.Fatalf("unexpected order %s", result)
+	}
+
+	indexFiles := getAvailableIndexFilesPath(dir)
+	source1, _ := os.Open(strings.Replace(indexFiles[0], indexFileSuffix, segmentFileSuffix, -1))
+	source2, _ := os.Open(strings.Replace(indexFiles[1], indexFileSuffix, segmentFileSuffix, -1))
+	target := createNewSegFile(dir)
+	merge(source1, source2, target, NoCompression, numericComparator{}, lsm.newVersionFilter())
+	closeFile(target)
+	removeFile(strings.Replace(target.Name(), segmentFileSuffix, unavailableFileSuffix, -1))
+	for _, file := range []*os.File{source1, source2} {
+		closeFile(file)
+		removeFile(file.Name())
+		removeFile(strings.Replace(file.Name(), segmentFileSuffix, indexFileSuffix, -1))
+	}
+	for _, key := range []string{"3", "9", "25", "100", "1000"} {
+		if _, ok := lsm.Get(key); !ok {
+			t.Fatalf("%s should exist after merge", key)
+		}
+	}
+	if result := keys(); result != "3=w3 9=v9 25=w25 100=v100 1000=w1000" {
+		t.Fatalf("unexpected order after merge %s", result)
+	}
+	lsm.Close()
+
+	// 比较器的名称被保存在元数据中，之后必须使用同名的比较器打开
+	if _, err := NewLsm(dir, false); err != ErrComparatorMismatch {
+		t.Fatal("opening with a different comparator should fail")
+	}
+	if _, err := NewLsmReaderWithOptions(dir, Options{}); err != ErrComparatorMismatch {
+		t.Fatal("reader with a different comparator should fail", err)
+	}
+	lsm, err = NewLsmWithOptions(dir, Options{Comparator: numericComparator{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsm.Close()
+
+	// 内置的比较器可以在没有指定比较器时从元数据中恢复
+	dir = t.TempDir()
+	lsm, _ = NewLsmWithOptions(dir, Options{Comparator: ReverseBytewiseComparator})
+	lsm.Set("a", "1")
+	lsm.Set("b", "2")
+	lsm.Close()
+	lsm, err = NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := keys(); result != "b=2 a=1" {
+		t.Fatalf("unexpected order %s", result)
+	}
+	lsm.Close()
+}
+
+// 把列族的所有段文件两两合并，直到只剩下一个段文件
+// 让所有废弃的段文件的等待时间都已经足够，然后删除它们
+func expireObsoleteSegments(cf *ColumnFamily) {
+	cf.compactionMutex.Lock()
+	defer cf.compactionMutex.Unlock()
+	for i := range cf.obsolete {
+		cf.obsolete[i].time = time.Time{}
+	}
+	cf.removeObsoleteSegments()
+}
+
+func mergeSegments(cf *ColumnFamily) {
+	indexFiles := getAvailableIndexFilesPath(cf.path)
+	for len(indexFiles) > 1 {
+		source1, _ := os.Open(strings.Replace(indexFiles[0], indexFileSuffix, segmentFileSuffix, -1))
+		source2, _ := os.Open(strings.Replace(indexFiles[1], indexFileSuffix, segmentFileSuffix, -1))
+		target := createNewSegFile(cf.path)
+		merge(source1, source2, target, cf.compression, cf.comparator, cf.newVersionFilter())
+		closeFile(target)
+		removeFile(strings.Replace(target.Name(), segmentFileSuffix, unavailableFileSuffix, -1))
+		for _, file := range []*os.File{source1, source2} {
+			closeFile(file)
+			removeFile(file.Name())
+			removeFile(strings.Replace(file.Name(), segmentFileSuffix, indexFileSuffix, -1))
+		}
+		indexFiles = getAvailableIndexFilesPath(cf.path)
+	}
+}
+
+// 生成随机的key，包括空字符串、二进制数据以及超过255字节的长key
+func randomKey(r *rand.Rand) string {
+	switch r.Intn(6) {
+	case 0:
+		return ""
+	case 1:
+		return string([]byte{0})
+	case 2:
+		return strings.Repeat(string(rune('a'+r.Intn(3))), 250+r.Intn(10))
+	default:
+		buf := make([]byte, r.Intn(4))
+		for i := range buf {
+			buf[i] = []byte{0, 1, 'a', 'b', 0x7f, 0xff}[r.Intn(6)]
+		}
+		return string(buf)
+	}
+}
+
+// 随机地写入和删除数据，检查刷盘以及合并段文件之后的结果和参照的map一致
+func TestMergeProperty(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		options := Options{}
+		if seed%2 == 1 {
+			options.Comparator = ReverseBytewiseComparator
+			options.Compression = FlateCompression
+		}
+		lsm, err := NewLsmWithOptions(t.TempDir(), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reference := make(map[string]string)
+		keys := make(map[string]bool)
+		for i := 0; i < 300; i++ {
+			key := randomKey(r)
+			keys[key] = true
+			if r.Intn(4) == 0 {
+				lsm.Delete(key)
+				delete(reference, key)
+			} else {
+				value := fmt.Sprint(r.Intn(1000))
+				lsm.Set(key, value)
+				reference[key] = value
+			}
+			if r.Intn(40) == 0 {
+				lsm.SyncMemTable()
+			}
+		}
+		lsm.SyncMemTable()
+		mergeSegments(lsm.ColumnFamily)
+
+		for key := range keys {
+			value, ok := lsm.Get(key)
+			expected, exists := reference[key]
+			if ok != exists || value != expected {
+				t.Fatalf("seed %d: key %q expected %q %v, got %q %v", seed, key, expected, exists, value, ok)
+			}
+		}
+		if result := iterate(lsm.NewIterator()); fmt.Sprint(result) != fmt.Sprint(reference) {
+			t.Fatalf("seed %d: expected %v, got %v", seed, reference, result)
+		}
+		lsm.Close()
+	}
+}
+
+func TestLiveReader(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsm.Set("a", "1")
+	lsm.SyncMemTable()
+	reader, _ := NewLsmReaderWithOptions(dir, Options{TailTransLog: true})
+	defer reader.Close()
+	if value, _ := reader.Get("a"); value != "1" || reader.Stale() {
+		t.Fatal("reader should see flushed data")
+	}
+
+	// 没有同步到段文件的数据需要刷新之后通过transLog读取
+	lsm.Set("b", "2")
+	if _, ok := reader.Get("b"); ok || !reader.Stale() {
+		t.Fatal("reader should be stale before refresh")
+	}
+	reader.Refresh()
+	if value, _ := reader.Get("b"); value != "2" || reader.Stale() {
+		t.Fatal("reader should see unflushed data after refresh")
+	}
+	lsm.SyncMemTable()
+	reader.Refresh()
+	if value, _ := reader.Get("b"); value != "2" {
+		t.Fatal("reader should see data after flush")
+	}
+
+	// 被Reader固定的旧段文件在Reader刷新之前不会被删除
+	segFilePath := path.Join(dir, "0"+segmentFileSuffix)
+	uaFile, _ := os.Create(strings.Replace(segFilePath, segmentFileSuffix, unavailableFileSuffix, -1))
+	closeFile(uaFile)
+	lsm.updateManifest()
+	// 等待时间已经足够的废弃段文件
+	lsm.obsolete = append(lsm.obsolete, obsoleteSegment{segFilePath, time.Time{}})
+	lsm.removeObsoleteSegments()
+	if _, err := os.Stat(segFilePath); err != nil {
+		t.Fatal("pinned segment should not be removed")
+	}
+	if value, _ := reader.Get("a"); value != "1" || !reader.Stale() {
+		t.Fatal("reader should still read the pinned segment")
+	}
+	reader.Refresh()
+	lsm.removeObsoleteSegments()
+	if _, err := os.Stat(segFilePath); !os.IsNotExist(err) {
+		t.Fatal("unpinned segment should be removed")
+	}
+	if _, ok := reader.Get("a"); ok {
+		t.Fatal("removed segment should not be read")
+	}
+
+	// 配置了刷新间隔的Reader会自动看到新的数据
+	autoReader, _ := NewLsmReaderWithOptions(dir, Options{RefreshInterval: time.Millisecond * 10})
+	lsm.Set("c", "3")
+	lsm.SyncMemTable()
+	for i := 0; i < 100; i++ {
+		if _, ok := autoReader.Get("c"); ok {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if value, _ := autoReader.Get("c"); value != "3" {
+		t.Fatal("reader should refresh automatically")
+	}
+	autoReader.Close()
+
+	// 无法写入标记文件时Reader仍然可以读取，只是不再固定段文件
+	readOnlyReader, _ := NewLsmReaderWithOptions(dir, Options{})
+	readOnlyReader.pinFilePath = path.Join(dir, "missing", "reader"+pinFileSuffix)
+	readOnlyReader.Refresh()
+	if value, _ := readOnlyReader.Get("c"); value != "3" || readOnlyReader.pinned {
+		t.Fatal("reader should work without a pin file")
+	}
+	readOnlyReader.Close()
+	lsm.Close()
+}
+
+func TestReaderReadAPI(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsmWithOptions(dir, Options{MergeOperator: Int64AddOperator{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsm.Set("a", "1")
+	lsm.Set("b", "2")
+	lsm.Merge("n", "5")
+	lsm.SyncMemTable()
+	lsm.Set("c", "3")
+	lsm.Delete("b")
+	lsm.Merge("n", "7")
+	reader, _ := NewLsmReaderWithOptions(dir, Options{MergeOperator: Int64AddOperator{}, TailTransLog: true})
+	defer reader.Close()
+
+	// Reader和Lsm通过同一套读取逻辑读取数据，结果需要完全一致
+	keys := []string{"n", "b", "x", "a", "c"}
+	for _, get := range []func([]string) ([]string, []bool){lsm.MultiGet, reader.MultiGet} {
+		values, found := get(keys)
+		if strings.Join(values, ",") != "12,,,1,3" || found[1] || found[2] || !found[0] || !found[3] || !found[4] {
+			t.Fatal("multi get returns wrong values", values, found)
+		}
+	}
+	if !reader.Has("a") || reader.Has("b") || !lsm.Has("n") || lsm.Has("b") {
+		t.Fatal("has returns wrong result")
+	}
+	for _, scan := range []func(string, string, func(string, string) bool){lsm.Scan, reader.Scan} {
+		result := ""
+		scan("a", "n", func(key string, value string) bool {
+			result += key + "=" + value + ";"
+			return true
+		})
+		if result != "a=1;c=3;" {
+			t.Fatal("scan returns wrong result", result)
+		}
+		result = ""
+		scan("b", "", func(key string, value string) bool {
+			result += key + "=" + value + ";"
+			return key != "c"
+		})
+		if result != "c=3;" {
+			t.Fatal("scan should stop when visit returns false", result)
+		}
+	}
+	iter := reader.NewIterator()
+	result := ""
+	for iter.Next() {
+		result += iter.Key() + "=" + iter.Value() + ";"
+	}
+	iter.Close()
+	if result != "a=1;c=3;n=12;" {
+		t.Fatal("reader iterator returns wrong result", result)
+	}
+
+	stats := reader.Stats()
+	if stats.Segments != 1 || stats.SegmentBytes == 0 || stats.MemTableEntries != 3 || stats.Compression.Blocks == 0 {
+		t.Fatal("reader stats are wrong", stats)
+	}
+	if lsm.Stats().Segments != 1 || lsm.Stats().MemTableEntries != 3 {
+		t.Fatal("lsm stats are wrong", lsm.Stats())
+	}
+	lsm.Close()
+}
+
+func TestMultiGet(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsmWithOptions(dir, Options{MaxVersions: 3, RowCacheSize: 1024 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	r := rand.New(rand.NewSource(1))
+	// 同一个key的多个版本分布在多个段文件以及多个数据块中
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 500; i++ {
+			key := fmt.Sprint(r.Intn(1000))
+			if r.Intn(5) == 0 {
+				lsm.Delete(key)
+			} else {
+				lsm.Set(key, strings.Repeat(fmt.Sprint(round), r.Intn(100)))
+			}
+		}
+		lsm.SyncMemTable()
+	}
+	lsm.Set("7", "memTable")
+
+	keys := make([]string, 0)
+	for i := 0; i < 600; i++ {
+		keys = append(keys, fmt.Sprint(r.Intn(1200)))
+	}
+	keys = append(keys, "7", keys[0], "")
+	for pass := 0; pass < 2; pass++ {
+		// 第二次查询时结果来自行缓存
+		values, found := lsm.MultiGet(keys)
+		for i, key := range keys {
+			value, ok := lsm.Get(key)
+			if values[i] != value || found[i] != ok {
+				t.Fatal("multi get differs from get", key, values[i], found[i], value, ok)
+			}
+		}
+	}
+	if values, _ := lsm.MultiGet([]string{"7"}); values[0] != "memTable" {
+		t.Fatal("multi get should read memTable first")
+	}
+	if values, found := lsm.MultiGet(nil); len(values) != 0 || len(found) != 0 {
+		t.Fatal("multi get of no keys should return empty results")
+	}
+}
+
+func TestDirectorLock(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewLsm(dir, false)
+	if !errors.Is(err, ErrLocked) || !strings.Contains(err.Error(), "pid="+fmt.Sprint(os.Getpid())) {
+		t.Fatal("second writer should be refused with holder info", err)
+	}
+	if err := ForceUnlock(dir); !errors.Is(err, ErrLocked) {
+		t.Fatal("lock held by a live process should not be forced", err)
+	}
+	lsm.Close()
+	if _, err := os.Stat(path.Join(dir, writeLockFile)); !os.IsNotExist(err) {
+		t.Fatal("lock file should be removed on close")
+	}
+
+	// 进程崩溃之后残留的锁文件不会阻止再次打开目录
+	lsm, err = NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsm.Set("a", "1")
+	crash(lsm)
+	if err := ForceUnlock(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, writeLockFile)); !os.IsNotExist(err) {
+		t.Fatal("stale lock file should be removed by force unlock")
+	}
+	lsm, err = NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := lsm.Get("a"); value != "1" {
+		t.Fatal("data should be recovered after crash")
+	}
+	lsm.Close()
+}
+
+// 模拟进程崩溃：停止后台协程并关闭文件，但是不同步memTable，也不删除transLog和锁文件
+func crash(lsm *Lsm) {
+	lsm.mutex.Lock()
+	lsm.closed = true
+	close(lsm.done)
+	lsm.mutex.Unlock()
+	lsm.background.Wait()
+	lsm.transLogFile.Close()
+	lsm.lockFile.Close()
+}
+
+func TestClose(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsmWithOptions(dir, Options{MergeOperator: Int64AddOperator{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, _ := lsm.OpenColumnFamily("users", Options{})
+	lsm.Set("a", "1")
+	snapshot := lsm.NewSnapshot()
+	txn := lsm.BeginTxn()
+	txn.Set("b", "2")
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatal("close should be idempotent", err)
+	}
+
+	// 关闭之后的写入以及返回error的读取都返回ErrClosed，其他读取不到任何数据
+	batch := NewBatch()
+	batch.Set(users, "a", "1")
+	for _, err := range []error{
+		lsm.Set("a", "2"), lsm.Delete("a"), users.SetWithTTL("a", "2", time.Hour), lsm.Merge("n", "1"),
+		lsm.Write(batch), lsm.SyncMemTable(), txn.Commit(),
+	} {
+		if err != ErrClosed {
+			t.Fatal("operation after close should return ErrClosed", err)
+		}
+	}
+	if _, err := lsm.OpenColumnFamily("metrics", Options{}); err != ErrClosed {
+		t.Fatal("open column family after close should return ErrClosed", err)
+	}
+	_, setErr := lsm.SetIfAbsent("c", "3")
+	_, casErr := lsm.CompareAndSet("a", "1", "3")
+	_, deleteErr := lsm.DeleteIfEquals("a", "1")
+	_, _, getErr := lsm.GetContext(context.Background(), "a")
+	_, iterErr := lsm.NewIteratorContext(context.Background())
+	for _, err := range []error{setErr, casErr, deleteErr, getErr, iterErr} {
+		if err != ErrClosed {
+			t.Fatal("read after close should return ErrClosed", err)
+		}
+	}
+	if lsm.Has("a") {
+		t.Fatal("lsm should not be usable after close")
+	}
+	if _, ok := snapshot.Get("a"); ok {
+		t.Fatal("snapshot should not read after close")
+	}
+	iter := lsm.NewIterator()
+	if iter.Next() || iter.Err() != ErrClosed {
+		t.Fatal("iterator should be empty after close", iter.Err())
+	}
+	iter.Close()
+
+	// 数据在关闭时已经同步到段文件中
+	lsm, err = NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := lsm.Get("a"); value != "1" {
+		t.Fatal("data should be persisted on close")
+	}
+
+	// 合并之后还没有来得及删除的段文件在重新打开时会被清理
+	lsm.Set("b", "2")
+	lsm.SyncMemTable()
+	lsm.Close()
+	segFilePath := path.Join(dir, "0"+segmentFileSuffix)
+	uaFile, _ := os.Create(strings.Replace(segFilePath, segmentFileSuffix, unavailableFileSuffix, -1))
+	closeFile(uaFile)
+	lsm, err = NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	if len(lsm.obsolete) != 1 || lsm.obsolete[0].path != segFilePath {
+		t.Fatal("unavailable segment should be obsolete", lsm.obsolete)
+	}
+	if _, segments, _ := readManifest(dir); len(segments) != 1 || segments[0] != "1"+segmentFileSuffix {
+		t.Fatal("manifest should not contain the unavailable segment", segments)
+	}
+
+	// 关闭时同步失败会返回错误，并保留transLog用于下次打开时恢复
+	failDir := t.TempDir()
+	failing, err := NewLsm(failDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing.Set("a", "1")
+	os.Mkdir(path.Join(failDir, "0"+segmentFileSuffix), 0755)
+	if err := failing.Close(); err == nil {
+		t.Fatal("close should report the failed flush")
+	}
+	os.Remove(path.Join(failDir, "0"+segmentFileSuffix))
+	failing, err = NewLsm(failDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := failing.Get("a"); value != "1" {
+		t.Fatal("data should be recovered from the transLog", value)
+	}
+	failing.Close()
+}
+
+// 在Err被调用指定次数之后变为已取消的ctx，用于在操作进行到一半时取消
+type countdownContext struct {
+	context.Context
+	remaining int
+}
+
+func (c *countdownContext) Err() error {
+	if c.remaining <= 0 {
+		return context.Canceled
+	}
+	c.remaining -= 1
+	return nil
+}
+
+func TestContext(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := lsm.SetContext(canceled, "a", "1"); err != context.Canceled || lsm.Has("a") {
+		t.Fatal("canceled set should not write", err)
+	}
+	for i := 0; i < 100; i++ {
+		lsm.SetContext(context.Background(), fmt.Sprintf("%03d", i), fmt.Sprint(i))
+	}
+	if _, _, err := lsm.GetContext(canceled, "001"); err != context.Canceled {
+		t.Fatal("canceled get should return ctx error", err)
+	}
+
+	// 同步到一半被取消时数据仍然保留在memTable中
+	if err := lsm.SyncMemTableContext(&countdownContext{context.Background(), 50}); err != context.Canceled {
+		t.Fatal("sync should be canceled", err)
+	}
+	if len(getIndexFilesPath(dir)) != 0 || lsm.memTable.Len() != 100 {
+		t.Fatal("canceled sync should not leave a segment")
+	}
+	lsm.SyncMemTable()
+	for i := 0; i < 100; i += 2 {
+		lsm.Delete(fmt.Sprintf("%03d", i))
+	}
+	lsm.SyncMemTable()
+	if value, ok, err := lsm.GetContext(context.Background(), "001"); value != "1" || !ok || err != nil {
+		t.Fatal("get should read segments", value, ok, err)
+	}
+
+	iter, err := lsm.NewIteratorContext(&countdownContext{context.Background(), 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for iter.Next() {
+		count += 1
+	}
+	iter.Close()
+	if iter.Err() != context.Canceled || count == 0 || count >= 50 {
+		t.Fatal("iterator should stop when canceled", count, iter.Err())
+	}
+
+	// 合并到一半被取消时不会留下任何文件，段文件保持不变
+	if err := lsm.CompactRangeContext(&countdownContext{context.Background(), 20}, "", ""); err != context.Canceled {
+		t.Fatal("compaction should be canceled", err)
+	}
+	if len(getIndexFilesPath(dir)) != 2 || isFileSuffixExist(dir, unavailableFileSuffix) {
+		t.Fatal("canceled compaction should leave segments untouched")
+	}
+	// 只有和范围有交集的段文件会被合并
+	if err := lsm.CompactRange("100", ""); err != nil || len(getIndexFilesPath(dir)) != 2 {
+		t.Fatal("compaction outside of all segments should do nothing", err)
+	}
+	if err := lsm.CompactRange("010", "020"); err != nil {
+		t.Fatal(err)
+	}
+	if len(getAvailableIndexFilesPath(dir)) != 1 || len(getUnavailableSegmentFilesPath(dir)) != 2 {
+		t.Fatal("compaction should replace segments with one segment")
+	}
+	// 旧的段文件在等待一段时间之后才会被删除
+	lsm.compactionMutex.Lock()
+	lsm.removeObsoleteSegments()
+	lsm.compactionMutex.Unlock()
+	if len(getIndexFilesPath(dir)) != 3 {
+		t.Fatal("inputs should be kept during the grace period")
+	}
+	expireObsoleteSegments(lsm.ColumnFamily)
+	if len(getIndexFilesPath(dir)) != 1 || isFileSuffixExist(dir, unavailableFileSuffix) {
+		t.Fatal("inputs should be removed after the grace period")
+	}
+	if _, segments, _ := readManifest(dir); len(segments) != 1 {
+		t.Fatal("manifest should contain the compacted segment", segments)
+	}
+	result := ""
+	lsm.Scan("", "", func(key string, value string) bool {
+		result += value + ","
+		return true
+	})
+	if strings.Count(result, ",") != 50 || !strings.HasPrefix(result, "1,3,5,") {
+		t.Fatal("compaction should keep live data", result)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	dir := t.TempDir()
+	metrics := NewMetrics()
+	lsm, err := NewLsmWithOptions(dir, Options{Metrics: metrics})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	users, err := lsm.OpenColumnFamily("users", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		lsm.Set("a", fmt.Sprint(i))
+		users.Set("b", fmt.Sprint(i))
+		lsm.SyncMemTable()
+	}
+	lsm.Get("a")
+	lsm.Get("missing")
+	if err := lsm.CompactRange("", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := lsm.Stats()
+	if stats.Flushes != 2 || stats.FlushDuration <= 0 {
+		t.Fatal("flushes should be counted", stats.Flushes, stats.FlushDuration)
+	}
+	if stats.Gets != 2 || stats.SegmentReads != 4 || stats.ReadAmplification() != 2 {
+		t.Fatal("segment reads should be counted", stats.Gets, stats.SegmentReads)
+	}
+	if stats.Merges != 1 || stats.MergeBytes == 0 || stats.Segments != 1 || stats.SegmentBytes == 0 {
+		t.Fatal("compaction should be counted", stats.Merges, stats.MergeBytes, stats.Segments)
+	}
+	if len(stats.Families) != 2 || stats.Families["users"].Segments != 2 || stats.Families["users"].Gets != 0 ||
+		stats.Families["users"].Compression.Blocks == 0 {
+		t.Fatal("families should have their own stats", stats.Families)
+	}
+
+	server := httptest.NewServer(metrics)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(body)
+	for _, line := range []string{
+		"# TYPE lsm_get_segment_reads histogram\n",
+		`lsm_get_segment_reads_bucket{family="default",le="2"} 2` + "\n",
+		`lsm_get_segment_reads_count{family="default"} 2` + "\n",
+		`lsm_merge_duration_seconds_count{family="default"} 1` + "\n",
+		`lsm_segments{family="default"} 1` + "\n",
+		`lsm_segments{family="users"} 2` + "\n",
+		"lsm_flush_duration_seconds_count 2\n",
+		"# TYPE lsm_block_cache_hits_total counter\n",
+	} {
+		if !strings.Contains(text, line) {
+			t.Fatal("metrics should contain", line, text)
+		}
+	}
+}
+
+// 记录收到的日志，只保存级别和描述
+type recordingLogger struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (l *recordingLogger) record(level string, msg string, fields []interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(fields)%2 != 0 {
+		panic("odd number of fields: " + msg)
+	}
+	l.events = append(l.events, level+" "+msg)
+}
+
+func (l *recordingLogger) Debug(msg string, fields ...interface{}) { l.record("DEBUG", msg, fields) }
+func (l *recordingLogger) Info(msg string, fields ...interface{})  { l.record("INFO", msg, fields) }
+func (l *recordingLogger) Warn(msg string, fields ...interface{})  { l.record("WARN", msg, fields) }
+func (l *recordingLogger) Error(msg string, fields ...interface{}) { l.record("ERROR", msg, fields) }
+
+func TestLogger(t *testing.T) {
+	if log.Flags() != log.LstdFlags {
+		t.Fatal("global logger should not be modified", log.Flags())
+	}
+	dir := t.TempDir()
+	logger := &recordingLogger{}
+	lsm, err := NewLsmWithOptions(dir, Options{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsm.Set("a", "1")
+	lsm.SyncMemTable()
+	lsm.Set("a", "2")
+	lsm.SyncMemTable()
+	lsm.Set("b", "1")
+	crash(lsm)
+	// transLog末尾不完整的条目会被丢弃
+	appendFile(path.Join(dir, transLog), []byte{1, 2, 3})
+
+	lsm, err = NewLsmWithOptions(dir, Options{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.CompactRange("", ""); err != nil {
+		t.Fatal(err)
+	}
+	lsm.Close()
+	expected := []string{
+		"INFO lock acquired",
+		"INFO memTable flushed",
+		"INFO memTable flushed",
+		"INFO lock acquired",
+		"WARN discard incomplete transLog data",
+		"INFO memTable flushed",
+		"INFO transLog recovered",
+		"INFO segments compacted",
+		"INFO lock released",
+	}
+	if strings.Join(logger.events, "\n") != strings.Join(expected, "\n") {
+		t.Fatal("unexpected events", logger.events)
+	}
+
+	var buf strings.Builder
+	NewStdLogger(log.New(&buf, "", 0)).Warn("event", "family", "default", "bytes", 3, "odd")
+	if buf.String() != "WARN event family=default bytes=3 !BADKEY=odd\n" {
+		t.Fatal("unexpected std logger output", buf.String())
+	}
+}
+
+// 按顺序记录收到的事件
+type recordingListener struct {
+	BaseEventListener
+	mutex  sync.Mutex
+	events []string
+	infos  []interface{}
+}
+
+func (l *recordingListener) record(event string, info interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.events = append(l.events, event)
+	l.infos = append(l.infos, info)
+}
+
+func (l *recordingListener) OnFlushBegin(info FlushInfo)      { l.record("flushBegin", info) }
+func (l *recordingListener) OnFlushEnd(info FlushInfo)        { l.record("flushEnd", info) }
+func (l *recordingListener) OnWALRotated(info WALRotatedInfo) { l.record("walRotated", info) }
+func (l *recordingListener) OnCompactionBegin(info CompactionInfo) {
+	l.record("compactionBegin", info)
+}
+func (l *recordingListener) OnCompactionEnd(info CompactionInfo)  { l.record("compactionEnd", info) }
+func (l *recordingListener) OnTableDeleted(info TableDeletedInfo) { l.record("tableDeleted", info) }
+func (l *recordingListener) OnBackgroundError(err error)          { l.record("backgroundError", err) }
+
+func TestEventListener(t *testing.T) {
+	dir := t.TempDir()
+	listener := &recordingListener{}
+	lsm, err := NewLsmWithOptions(dir, Options{EventListener: listener})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	lsm.Set("a", "1")
+	lsm.SyncMemTable()
+	lsm.Set("a", "2")
+	lsm.Set("b", "2")
+	lsm.SyncMemTable()
+	if err := lsm.CompactRange("", ""); err != nil {
+		t.Fatal(err)
+	}
+	expireObsoleteSegments(lsm.ColumnFamily)
+	expected := "flushBegin,flushEnd,walRotated,flushBegin,flushEnd,walRotated,compactionBegin,compactionEnd,tableDeleted,tableDeleted"
+	if strings.Join(listener.events, ",") != expected {
+		t.Fatal("unexpected events", listener.events)
+	}
+
+	flush := listener.infos[4].(FlushInfo)
+	if flush.Family != defaultColumnFamily || flush.Records != 2 || flush.Err != nil || flush.Bytes == 0 {
+		t.Fatal("unexpected flush info", flush)
+	}
+	if rotated := listener.infos[5].(WALRotatedInfo); rotated.Bytes == 0 || rotated.Path != path.Join(dir, transLog) {
+		t.Fatal("unexpected rotation info", rotated)
+	}
+	compaction := listener.infos[7].(CompactionInfo)
+	if compaction.Inputs[1] != flush.Segment || compaction.Output == flush.Segment {
+		t.Fatal("compaction should replace flushed segments", compaction, flush)
+	}
+	if !compaction.Manual || len(compaction.Inputs) != 2 || compaction.InputBytes == 0 || compaction.OutputBytes == 0 {
+		t.Fatal("unexpected compaction info", compaction)
+	}
+	for i, input := range compaction.Inputs {
+		deleted := listener.infos[8+i].(TableDeletedInfo)
+		if deleted.Segment != input {
+			t.Fatal("inputs should be deleted after compaction", deleted, input)
+		}
+		if _, err := os.Stat(input); !os.IsNotExist(err) {
+			t.Fatal("deleted segment should not exist", input)
+		}
+	}
+
+	// 被取消的合并同样会通知结束事件
+	lsm.Set("c", "3")
+	lsm.SyncMemTable()
+	canceled := &countdownContext{context.Background(), 1}
+	if err := lsm.CompactRangeContext(canceled, "", ""); err != context.Canceled {
+		t.Fatal("compaction should be canceled", err)
+	}
+	if aborted := listener.infos[len(listener.infos)-1].(CompactionInfo); aborted.Err != context.Canceled || aborted.Output != "" {
+		t.Fatal("aborted compaction should report its error", aborted)
+	}
+
+	// 后台删除废弃的段文件失败时通知监听器，之后再次尝试删除
+	blocked := path.Join(dir, "100"+segmentFileSuffix)
+	os.MkdirAll(path.Join(blocked, "child"), 0755)
+	lsm.compactionMutex.Lock()
+	lsm.obsolete = append(lsm.obsolete, obsoleteSegment{blocked, time.Time{}})
+	lsm.compactionMutex.Unlock()
+	lsm.backgroundMergeOnce()
+	if _, ok := listener.infos[len(listener.infos)-1].(error); !ok || len(lsm.obsolete) != 1 {
+		t.Fatal("background error should be reported", listener.events)
+	}
+	os.Remove(path.Join(blocked, "child"))
+	lsm.backgroundMergeOnce()
+	if listener.events[len(listener.events)-1] != "tableDeleted" || len(lsm.obsolete) != 0 {
+		t.Fatal("obsolete segment should be removed on retry", listener.events)
+	}
+}
+
+func TestReadDataFiles(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsm(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	users, _ := lsm.OpenColumnFamily("users", Options{})
+	for i := 0; i < 1000; i++ {
+		lsm.Set(fmt.Sprintf("%04d", i), strings.Repeat("v", 10))
+	}
+	lsm.Delete("0001")
+	lsm.SyncMemTable()
+	batch := NewBatch()
+	batch.Set(users, "alice", "1")
+	batch.Delete(lsm.ColumnFamily, "0002")
+	lsm.Write(batch)
+	lsm.SetWithTTL("ttl", "x", time.Hour)
+
+	indexFilePath := getIndexFilesPath(dir)[0]
+	indices, err := ReadIndex(indexFilePath)
+	if err != nil || len(indices) < 2 || indices[0].Offset() != 0 || indices[len(indices)-1].Key() != "0999" {
+		t.Fatal("unexpected indices", err, indices)
+	}
+	records, blocks := make([]Record, 0), make(map[uint32]string)
+	err = ReadSegment(strings.Replace(indexFilePath, indexFileSuffix, segmentFileSuffix, -1), func(offset uint32, r Record) bool {
+		records = append(records, r)
+		blocks[offset] = r.Key
+		return true
+	})
+	if err != nil || len(records) != 1000 || records[1].Kind != "deletion" || records[2].Kind != "value" {
+		t.Fatal("unexpected records", err, len(records))
+	}
+	for _, index := range indices {
+		if blocks[index.Offset()] != index.Key() {
+			t.Fatal("index should point to the last key of each block", index.Key(), blocks[index.Offset()])
+		}
+	}
+	// 损坏的段文件和索引文件返回错误
+	damaged := path.Join(t.TempDir(), "0"+segmentFileSuffix)
+	segData, _ := ioutil.ReadFile(strings.Replace(indexFilePath, indexFileSuffix, segmentFileSuffix, -1))
+	ioutil.WriteFile(damaged, segData[:len(segData)-10], 0644)
+	count := 0
+	err = ReadSegment(damaged, func(uint32, Record) bool {
+		count += 1
+		return true
+	})
+	if !errors.Is(err, ErrCorruptSegment) || count == 0 || count >= 1000 {
+		t.Fatal("truncated segment should be reported after the readable records", err, count)
+	}
+	ioutil.WriteFile(damaged, []byte{0xff, 1, 2}, 0644)
+	if _, err := ReadIndex(damaged); err == nil {
+		t.Fatal("corrupt index should be reported")
+	}
+
+	result := ""
+	discarded, err := ReadTransLog(path.Join(dir, transLog), func(entry int, r Record) bool {
+		result += fmt.Sprintf("%d:%s:%s:%s:%v,", entry, r.Family, r.Kind, r.Key, r.TTL)
+		return true
+	})
+	if err != nil || discarded != 0 || result != "0:users:value:alice:0s,0:default:deletion:0002:0s,1:default:value:ttl:1h0m0s," {
+		t.Fatal("unexpected transLog records", err, discarded, result)
+	}
+	appendFile(path.Join(dir, transLog), []byte{1, 2, 3})
+	if discarded, _ := ReadTransLog(path.Join(dir, transLog), func(int, Record) bool { return true }); discarded != 3 {
+		t.Fatal("incomplete entry should be reported", discarded)
+	}
+}
+
+func TestVerifyAndRepair(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, _ := lsm.OpenColumnFamily("users", Options{})
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := 0; i < 1000; i++ {
+			lsm.Set(fmt.Sprintf("%s%04d", prefix, i), strings.Repeat("v", 10))
+		}
+		lsm.SyncMemTable()
+	}
+	users.Set("alice", "1")
+	lsm.Close()
+	if report, err := Verify(dir); err != nil || !report.OK() || report.Segments != 4 || report.Records != 3001 {
+		t.Fatal("data should be intact", err, report)
+	}
+
+	// 损坏0.seg第二个数据块的头部，删除1.seg的索引，制造孤立的文件以及不完整的transLog
+	indices, _ := ReadIndex(path.Join(dir, "0.i"))
+	segFile, _ := os.OpenFile(path.Join(dir, "0.seg"), os.O_WRONLY, 0644)
+	segFile.WriteAt([]byte{0xff, 0xff, 0xff, 0x7f}, int64(indices[1].Offset())+5)
+	segFile.Close()
+	os.Remove(path.Join(dir, "1.i"))
+	ioutil.WriteFile(path.Join(dir, "7.i"), nil, 0644)
+	ioutil.WriteFile(path.Join(dir, "users", "8.ua"), nil, 0644)
+	ioutil.WriteFile(path.Join(dir, transLog), encodeTransLogEntry([]record{{"d", Data{value: "1", kind: typeValue, timestamp: 1}, defaultColumnFamily}})[:10], 0644)
+
+	report, err := Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := make([]string, 0)
+	for _, problem := range report.Problems {
+		problems = append(problems, path.Base(problem.Path)+": "+strings.SplitN(problem.Reason, ":", 2)[0])
+	}
+	sort.Strings(problems)
+	expected := []string{
+		"0.seg: corrupt block at offset " + fmt.Sprint(indices[1].Offset()),
+		"1.seg: segment without index",
+		"7.i: index without segment",
+		"8.ua: unavailable flag without segment",
+		"translog: 10 bytes of incomplete entry at offset 0",
+	}
+	if strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+		t.Fatal("unexpected problems", problems)
+	}
+
+	lsm, _ = NewLsm(dir, false)
+	if _, err := Repair(dir); !errors.Is(err, ErrLocked) {
+		t.Fatal("repair should not run while the lsm is open", err)
+	}
+	crash(lsm)
+	// 打开LSM时已经重新生成了1.seg的索引
+	os.Remove(path.Join(dir, "1.i"))
+	ioutil.WriteFile(path.Join(dir, transLog), encodeTransLogEntry([]record{{"d", Data{value: "1", kind: typeValue, timestamp: 1}, defaultColumnFamily}})[:10], 0644)
+	report, err = Repair(dir)
+	if err != nil || len(report.Problems) != 5 || len(report.Actions) != 7 {
+		t.Fatal("unexpected repair", err, report)
+	}
+	if report, err := Verify(dir); err != nil || !report.OK() {
+		t.Fatal("repaired data should be intact", err, report)
+	}
+	if _, err := os.Stat(path.Join(dir, "0.seg"+corruptFileSuffix)); err != nil {
+		t.Fatal("corrupt segment should be quarantined", err)
+	}
+
+	lsm, err = NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	users, _ = lsm.OpenColumnFamily("users", Options{})
+	lost := 0
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := 0; i < 1000; i++ {
+			if !lsm.Has(fmt.Sprintf("%s%04d", prefix, i)) {
+				lost += 1
+			}
+		}
+	}
+	// 只有损坏的数据块中的记录会丢失
+	if lost == 0 || lost > 200 || !lsm.Has("a0000") || !lsm.Has("a0999") || !users.Has("alice") {
+		t.Fatal("readable records should be salvaged", lost)
+	}
+
+	// 头部中不合理的原始长度在解压之前就被拒绝
+	blockFilePath := path.Join(t.TempDir(), "block")
+	for _, header := range [][]byte{
+		append(append([]byte{byte(FlateCompression)}, uint32ToBytes(0xffffffff)...), uint32ToBytes(4)...),
+		append(append([]byte{byte(NoCompression)}, uint32ToBytes(8)...), uint32ToBytes(4)...),
+	} {
+		ioutil.WriteFile(blockFilePath, append(header, 1, 2, 3, 4), 0644)
+		file, _ := os.Open(blockFilePath)
+		if _, _, err := readBlockChecked(file, 0, blockHeaderSize+4); err == nil {
+			t.Fatal("block with invalid raw length should be rejected", header)
+		}
+		file.Close()
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		lsm.Set(fmt.Sprintf("%04d", i), strings.Repeat("v", 10))
+	}
+	lsm.Close()
+	segFilePath, indexFilePath := path.Join(dir, "0.seg"), path.Join(dir, "0.i")
+	indexData, _ := ioutil.ReadFile(indexFilePath)
+	if err := RebuildIndex(segFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt, _ := ioutil.ReadFile(indexFilePath); string(rebuilt) != string(indexData) {
+		t.Fatal("rebuilt index should be the same as the original one")
+	}
+	if err := RebuildIndex(indexFilePath); err == nil {
+		t.Fatal("index file is not a segment")
+	}
+
+	// 没有索引的段文件在打开时重新生成索引
+	os.Remove(indexFilePath)
+	logger := &recordingLogger{}
+	lsm, err = NewLsmWithOptions(dir, Options{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := lsm.Get("0500"); !ok || value != strings.Repeat("v", 10) {
+		t.Fatal("segment should be readable after its index is rebuilt")
+	}
+	if rebuilt, _ := ioutil.ReadFile(indexFilePath); string(rebuilt) != string(indexData) {
+		t.Fatal("index should be rebuilt at open")
+	}
+	if _, segments, _ := readManifest(dir); len(segments) != 1 || logger.events[1] != "INFO index rebuilt" {
+		t.Fatal("rebuilt segment should be in the manifest", segments, logger.events)
+	}
+	lsm.Close()
+
+	// 损坏的段文件不会被重新生成索引，仍然不可见
+	os.Remove(indexFilePath)
+	os.Truncate(segFilePath, 100)
+	if err := RebuildIndex(segFilePath); !errors.Is(err, ErrCorruptSegment) {
+		t.Fatal("corrupt segment should not be indexed", err)
+	}
+	lsm, err = NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	if _, err := os.Stat(indexFilePath); !os.IsNotExist(err) || lsm.Has("0000") {
+		t.Fatal("corrupt segment should stay invisible")
+	}
+}
+
+// 按照最初的格式写入段文件和索引文件
+func writeLegacySegment(t *testing.T, dir string, name string, keys []string, value string, timestamp uint64) {
+	var seg, index []byte
+	for _, key := range keys {
+		index = append(index, append(addBufHead([]byte(key)), uint32ToBytes(uint32(len(seg)))...)...)
+		seg = append(seg, addBufHead([]byte(key))...)
+		seg = append(seg, addBufHead([]byte(value))...)
+		seg = append(seg, uint64ToBytes(timestamp)...)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, name+segmentFileSuffix), seg, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, name+indexFileSuffix), index, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyFormat(t *testing.T) {
+	dir := t.TempDir()
+	writeLegacySegment(t, dir, "0", []string{"a", "b", "c"}, "old", 1)
+	writeLegacySegment(t, dir, "1", []string{"b", "d"}, strings.Repeat("new", 100), 2)
+	if _, err := NewLsmReaderWithOptions(dir, Options{}); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatal("reader should not read legacy segments", err)
+	}
+
+	lsm, err := NewLsm(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"a": "old", "b": strings.Repeat("new", 100), "c": "old", "d": strings.Repeat("new", 100)}
+	for key, value := range expected {
+		if v, ok := lsm.Get(key); !ok || v != value {
+			t.Fatal("legacy data should be migrated", key, v)
+		}
+	}
+	lsm.Close()
+	metadata := readMetadata(dir)
+	if metadata[formatMetadataKey] != "2" || metadata[migrateFromMetadataKey] != "" {
+		t.Fatal("format version should be recorded", metadata)
+	}
+	for _, name := range []string{"0.seg", "1.seg", "0.i", "1.i", "2.ua", "3.ua"} {
+		if _, err := os.Stat(path.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatal("legacy segment and unavailable files should be removed", name)
+		}
+	}
+	reader, err := NewLsmReaderWithOptions(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := reader.Get("b"); !ok || v != expected["b"] {
+		t.Fatal("reader should read migrated segments", v)
+	}
+	reader.Close()
+
+	// 损坏的旧格式段文件和未知的格式版本都返回错误
+	dir = t.TempDir()
+	writeLegacySegment(t, dir, "0", []string{"a"}, "v", 1)
+	os.Truncate(path.Join(dir, "0.seg"), 4)
+	if _, err := NewLsm(dir, false); !errors.Is(err, ErrCorruptSegment) {
+		t.Fatal("corrupt legacy segment should be reported", err)
+	}
+	dir = t.TempDir()
+	writeMetadata(dir, map[string]string{formatMetadataKey: "3"})
+	if _, err := NewLsm(dir, false); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatal("unknown format should be reported", err)
+	}
+}
@@ -0,0 +1,170 @@
+package lsm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 读取目录中的清单，返回清单的版本号以及其中记录的段文件名称，清单不存在时返回false。
+// 清单的第一行是版本号，之后每一行是一个可用的段文件名称
+func readManifest(director string) (uint64, []string, bool) {
+	content, err := ioutil.ReadFile(path.Join(director, manifestFile))
+	if os.IsNotExist(err) {
+		return 0, nil, false
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	version, err := strconv.ParseUint(lines[0], 10, 64)
+	if err != nil {
+		log.Fatal(err)
+	}
+	segments := make([]string, 0, len(lines)-1)
+	for _, line := range lines[1:] {
+		if line != "" {
+			segments = append(segments, line)
+		}
+	}
+	return version, segments, true
+}
+
+// 把目录中当前可用的段文件写入清单，先写临时文件再重命名，保证Reader总是读到完整的清单
+func (cf *ColumnFamily) updateManifest() {
+	cf.manifestMutex.Lock()
+	defer cf.manifestMutex.Unlock()
+	writeManifest(cf.path)
+}
+
+// 把目录中当前可用的段文件写入清单，调用者需要保证没有其他人同时修改清单
+func writeManifest(director string) {
+	version, _, _ := readManifest(director)
+	content := strconv.FormatUint(version+1, 10) + "\n"
+	for _, indexFilePath := range getAvailableIndexFilesPath(director) {
+		content += path.Base(strings.Replace(indexFilePath, indexFileSuffix, segmentFileSuffix, -1)) + "\n"
+	}
+	tmpFilePath := path.Join(director, manifestFile+".tmp")
+	err := ioutil.WriteFile(tmpFilePath, []byte(content), 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.Rename(tmpFilePath, path.Join(director, manifestFile))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+var pinFileCount uint64 // 当前进程已经创建的标记文件数量，用于生成唯一的标记文件名称
+
+// 生成一个新的标记文件路径
+func newPinFilePath(director string) string {
+	count := atomic.AddUint64(&pinFileCount, 1)
+	return path.Join(director, fmt.Sprintf("%d-%d%s", os.Getpid(), count, pinFileSuffix))
+}
+
+// 在标记文件中记录Reader正在读取的段文件，这些段文件在标记文件有效期间不会被删除，
+// 没有写入权限等原因导致失败时返回错误，并且不会留下临时文件
+func writePinFile(pinFilePath string, indexFilesPath []string) error {
+	content := ""
+	for _, indexFilePath := range indexFilesPath {
+		content += path.Base(strings.Replace(indexFilePath, indexFileSuffix, segmentFileSuffix, -1)) + "\n"
+	}
+	tmpFilePath := pinFilePath + ".tmp"
+	err := ioutil.WriteFile(tmpFilePath, []byte(content), 0644)
+	if err == nil {
+		err = os.Rename(tmpFilePath, pinFilePath)
+	}
+	if err != nil {
+		os.Remove(tmpFilePath)
+	}
+	return err
+}
+
+// 获取目录中所有被有效的标记文件固定的段文件名称，同时删除已经过期的标记文件
+func pinnedSegments(director string) map[string]bool {
+	files, err := ioutil.ReadDir(director)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pinned := make(map[string]bool)
+	for _, file := range files {
+		if !file.Mode().IsRegular() || !strings.HasSuffix(file.Name(), pinFileSuffix) {
+			continue
+		}
+		pinFilePath := path.Join(director, file.Name())
+		if time.Since(file.ModTime()) > time.Second*pinLeaseTime {
+			// 标记文件很久没有被续期，创建它的Reader可能已经异常退出
+			os.Remove(pinFilePath)
+			continue
+		}
+		content, err := ioutil.ReadFile(pinFilePath)
+		if err != nil {
+			// 标记文件可能刚刚被Reader删除
+			continue
+		}
+		for _, name := range strings.Split(string(content), "\n") {
+			if name != "" {
+				pinned[name] = true
+			}
+		}
+	}
+	return pinned
+}
+
+// 已经被打上不可用标志但是还没有被删除的段文件
+type obsoleteSegment struct {
+	path string
+	time time.Time // 被打上不可用标志的时间
+}
+
+// 把已经打上不可用标志的段文件记录为废弃的段文件，调用者需要持有合并锁
+func (cf *ColumnFamily) markObsolete(segments []string) {
+	now := time.Now()
+	for _, segFilePath := range segments {
+		cf.obsolete = append(cf.obsolete, obsoleteSegment{segFilePath, now})
+	}
+}
+
+// 删除已经被合并的旧段文件。旧的段文件被打上不可用标志之后，其他进程中的Reader可能还没有固定新的段文件，
+// 因此需要等待一段时间之后再删除；被Reader固定的段文件、等待时间还不够的段文件以及删除失败的段文件会在之后的检查中再次尝试删除，
+// 返回第一个删除失败的错误
+func (cf *ColumnFamily) removeObsoleteSegments() error {
+	if len(cf.obsolete) == 0 {
+		return nil
+	}
+	pinned := pinnedSegments(cf.path)
+	remaining := make([]obsoleteSegment, 0)
+	var err error
+	for _, segment := range cf.obsolete {
+		segFilePath := segment.path
+		if err != nil || pinned[path.Base(segFilePath)] || time.Since(segment.time) < time.Second*waitOldSegFileDelTime {
+			remaining = append(remaining, segment)
+			continue
+		}
+		// 删除段文件，索引文件，不可用文件，不可用文件最后删除，删除失败时段文件仍然不会被读取
+		cf.lsm.blockCache.evictSegment(segFilePath)
+		for _, filePath := range []string{
+			segFilePath,
+			strings.Replace(segFilePath, segmentFileSuffix, indexFileSuffix, -1),
+			strings.Replace(segFilePath, segmentFileSuffix, unavailableFileSuffix, -1),
+		} {
+			if err = removeFileIfExists(filePath); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			remaining = append(remaining, segment)
+			continue
+		}
+		cf.lsm.listener.OnTableDeleted(TableDeletedInfo{Family: cf.name, Segment: segFilePath})
+	}
+	cf.obsolete = remaining
+	return err
+}
@@ -0,0 +1,354 @@
+package lsm
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 直方图默认的桶上界，适用于以秒为单位的耗时
+var DefaultBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// 计数器，只能增加
+type Counter struct {
+	mutex sync.Mutex
+	value float64
+}
+
+func (c *Counter) Add(value float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.value += value
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Value() float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.value
+}
+
+func (c *Counter) write(w io.Writer, name string, labels string) {
+	writeSample(w, name, labels, c.Value())
+}
+
+// 仪表盘，可以被设置为任意值
+type Gauge struct {
+	mutex sync.Mutex
+	value float64
+}
+
+func (g *Gauge) Set(value float64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.value = value
+}
+
+func (g *Gauge) Add(value float64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.value += value
+}
+
+func (g *Gauge) Value() float64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.value
+}
+
+func (g *Gauge) write(w io.Writer, name string, labels string) {
+	writeSample(w, name, labels, g.Value())
+}
+
+// 直方图，统计观测值落在每个桶中的次数以及所有观测值的总和
+type Histogram struct {
+	mutex       sync.Mutex
+	upperBounds []float64 // 每个桶的上界，从小到大排列
+	counts      []uint64  // 每个桶中的观测次数，不是累计值
+	count       uint64
+	sum         float64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	upperBounds := make([]float64, len(buckets))
+	copy(upperBounds, buckets)
+	sort.Float64s(upperBounds)
+	return &Histogram{upperBounds: upperBounds, counts: make([]uint64, len(upperBounds))}
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	i := sort.SearchFloat64s(h.upperBounds, value)
+	if i < len(h.counts) {
+		h.counts[i] += 1
+	}
+	h.count += 1
+	h.sum += value
+}
+
+// 观测的次数
+func (h *Histogram) Count() uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.count
+}
+
+// 所有观测值的总和
+func (h *Histogram) Sum() float64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.sum
+}
+
+func (h *Histogram) write(w io.Writer, name string, labels string) {
+	h.mutex.Lock()
+	counts := make([]uint64, len(h.counts))
+	copy(counts, h.counts)
+	count, sum := h.count, h.sum
+	h.mutex.Unlock()
+	var cumulative uint64
+	for i, upperBound := range h.upperBounds {
+		cumulative += counts[i]
+		writeSample(w, name+"_bucket", joinLabels(labels, `le="`+formatFloat(upperBound)+`"`), float64(cumulative))
+	}
+	writeSample(w, name+"_bucket", joinLabels(labels, `le="+Inf"`), float64(count))
+	writeSample(w, name+"_sum", labels, sum)
+	writeSample(w, name+"_count", labels, float64(count))
+}
+
+// 每次导出时通过函数获取值的指标
+type funcCollector struct {
+	mutex sync.Mutex
+	fn    func() float64
+}
+
+func (f *funcCollector) write(w io.Writer, name string, labels string) {
+	f.mutex.Lock()
+	fn := f.fn
+	f.mutex.Unlock()
+	writeSample(w, name, labels, fn())
+}
+
+type collector interface {
+	write(w io.Writer, name string, labels string)
+}
+
+// 同名的一组指标，它们的标签各不相同
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string // counter、gauge或者histogram
+	labels []string
+	series map[string]collector // 标签到指标的映射
+}
+
+// 指标注册表，以Prometheus文本格式导出所有注册的计数器、仪表盘和直方图，它本身就是一个http.Handler。
+// 通过Options.Metrics传给LSM之后，LSM会把自己的指标注册到其中，一个注册表只能用于一个LSM
+type Metrics struct {
+	mutex    sync.Mutex
+	families map[string]*metricFamily
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{families: make(map[string]*metricFamily)}
+}
+
+// 注册一个计数器，labels是依次排列的标签名和标签值，同名同标签的计数器已经存在时直接返回它
+func (m *Metrics) NewCounter(name string, help string, labels ...string) *Counter {
+	return m.register(name, help, "counter", labels, func() collector { return &Counter{} }).(*Counter)
+}
+
+// 注册一个仪表盘，同名同标签的仪表盘已经存在时直接返回它
+func (m *Metrics) NewGauge(name string, help string, labels ...string) *Gauge {
+	return m.register(name, help, "gauge", labels, func() collector { return &Gauge{} }).(*Gauge)
+}
+
+// 注册一个直方图，buckets是每个桶的上界，同名同标签的直方图已经存在时直接返回它
+func (m *Metrics) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	return m.register(name, help, "histogram", labels, func() collector { return newHistogram(buckets) }).(*Histogram)
+}
+
+// 注册一个在导出时才通过fn获取值的仪表盘，同名同标签的指标已经存在时替换它的fn
+func (m *Metrics) NewGaugeFunc(name string, help string, fn func() float64, labels ...string) {
+	m.registerFunc(name, help, "gauge", fn, labels)
+}
+
+// 注册一个在导出时才通过fn获取值的计数器，fn的返回值不能减小，同名同标签的指标已经存在时替换它的fn
+func (m *Metrics) NewCounterFunc(name string, help string, fn func() float64, labels ...string) {
+	m.registerFunc(name, help, "counter", fn, labels)
+}
+
+func (m *Metrics) registerFunc(name string, help string, kind string, fn func() float64, labels []string) {
+	f := m.register(name, help, kind, labels, func() collector { return &funcCollector{} }).(*funcCollector)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.fn = fn
+}
+
+func (m *Metrics) register(name string, help string, kind string, labels []string, create func() collector) collector {
+	if len(labels)%2 != 0 {
+		panic("metric " + name + " has an odd number of label arguments")
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	family, ok := m.families[name]
+	if !ok {
+		family = &metricFamily{name: name, help: help, kind: kind, series: make(map[string]collector)}
+		m.families[name] = family
+	} else if family.kind != kind {
+		panic("metric " + name + " is already registered as a " + family.kind)
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escapeLabelValue(labels[i+1])+`"`)
+	}
+	key := strings.Join(pairs, ",")
+	c, ok := family.series[key]
+	if !ok {
+		c = create()
+		family.series[key] = c
+		family.labels = append(family.labels, key)
+	}
+	return c
+}
+
+// 以Prometheus文本格式写出所有的指标，指标按照名称排序
+func (m *Metrics) WriteText(w io.Writer) error {
+	m.mutex.Lock()
+	families := make([]*metricFamily, 0, len(m.families))
+	for _, family := range m.families {
+		families = append(families, family)
+	}
+	series := make(map[*metricFamily][]collector)
+	labels := make(map[*metricFamily][]string)
+	for _, family := range families {
+		labels[family] = append([]string(nil), family.labels...)
+		for _, key := range family.labels {
+			series[family] = append(series[family], family.series[key])
+		}
+	}
+	m.mutex.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	// 导出时不持有注册表的锁，函数类型的指标可能需要获取LSM的锁
+	buf := bufio.NewWriter(w)
+	for _, family := range families {
+		buf.WriteString("# HELP " + family.name + " " + escapeHelp(family.help) + "\n")
+		buf.WriteString("# TYPE " + family.name + " " + family.kind + "\n")
+		for i, c := range series[family] {
+			c.write(buf, family.name, labels[family][i])
+		}
+	}
+	return buf.Flush()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := m.WriteText(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// 写出一行样本
+func writeSample(w io.Writer, name string, labels string, value float64) {
+	line := name
+	if labels != "" {
+		line += "{" + labels + "}"
+	}
+	io.WriteString(w, line+" "+formatFloat(value)+"\n")
+}
+
+func joinLabels(labels string, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// 注册LSM级别的指标
+func (l *Lsm) registerMetrics() {
+	l.flushDuration = l.metrics.NewHistogram("lsm_flush_duration_seconds", "Time spent flushing memTables to segments.", DefaultBuckets)
+	l.metrics.NewGaugeFunc("lsm_translog_bytes", "Size of the transLog.", func() float64 {
+		l.mutex.RLock()
+		defer l.mutex.RUnlock()
+		return float64(l.transLogBytes())
+	})
+	l.metrics.NewCounterFunc("lsm_block_cache_hits_total", "Block cache hits.", func() float64 {
+		return float64(l.blockCache.Stats().Hits)
+	})
+	l.metrics.NewCounterFunc("lsm_block_cache_misses_total", "Block cache misses.", func() float64 {
+		return float64(l.blockCache.Stats().Misses)
+	})
+	l.metrics.NewGaugeFunc("lsm_block_cache_bytes", "Bytes used by the block cache.", func() float64 {
+		return float64(l.blockCache.Stats().Size)
+	})
+}
+
+// 注册列族的指标，列族的名称作为family标签
+func (cf *ColumnFamily) registerMetrics() {
+	metrics := cf.lsm.metrics
+	cf.segmentReads = metrics.NewHistogram("lsm_get_segment_reads", "Segments searched per Get.",
+		[]float64{0, 1, 2, 4, 8, 16, 32}, "family", cf.name)
+	cf.mergeDuration = metrics.NewHistogram("lsm_merge_duration_seconds", "Time spent merging segments.",
+		DefaultBuckets, "family", cf.name)
+	cf.mergeBytes = metrics.NewCounter("lsm_merge_bytes_total", "Bytes of segments written by merges.", "family", cf.name)
+	metrics.NewGaugeFunc("lsm_segments", "Number of available segments.", func() float64 {
+		return float64(len(getAvailableIndexFilesPath(cf.path)))
+	}, "family", cf.name)
+	metrics.NewGaugeFunc("lsm_segment_bytes", "Bytes of available segments.", func() float64 {
+		return float64(getSegmentBytes(getAvailableIndexFilesPath(cf.path)))
+	}, "family", cf.name)
+	metrics.NewGaugeFunc("lsm_memtable_bytes", "Bytes of records in the memTable.", func() float64 {
+		cf.lsm.mutex.RLock()
+		defer cf.lsm.mutex.RUnlock()
+		return float64(getMemTableSize(cf.memTable))
+	}, "family", cf.name)
+	metrics.NewCounterFunc("lsm_row_cache_hits_total", "Row cache hits.", func() float64 {
+		return float64(cf.rowCache.stats().Hits)
+	}, "family", cf.name)
+	metrics.NewCounterFunc("lsm_row_cache_misses_total", "Row cache misses.", func() float64 {
+		return float64(cf.rowCache.stats().Misses)
+	}, "family", cf.name)
+}
+
+// 记录一次合并的耗时以及生成的段文件的大小
+func (cf *ColumnFamily) observeMerge(start time.Time, segFilePath string) {
+	cf.mergeDuration.Observe(time.Since(start).Seconds())
+	info, err := os.Stat(segFilePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cf.mergeBytes.Add(float64(info.Size()))
+}
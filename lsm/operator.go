@@ -0,0 +1,116 @@
+package lsm
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrNoMergeOperator = errors.New("merge operator is not configured")
+
+// 合并操作符，用于在不读取旧值的情况下修改key的值（例如计数器、追加列表），
+// 写入时只记录操作数，读取时以及合并段文件时才把操作数合并到旧值上
+type MergeOperator interface {
+	// 把操作数按照从旧到新的顺序依次应用到已有的值上，exists为false表示key当前不存在
+	FullMerge(key string, existing string, exists bool, operands []string) string
+	// 把两个相邻的操作数合并为一个操作数，无法合并时返回false
+	PartialMerge(key string, older string, newer string) (string, bool)
+}
+
+// 把操作数作为int64累加到已有的值上，无法解析的值视为0
+type Int64AddOperator struct{}
+
+func (Int64AddOperator) FullMerge(key string, existing string, exists bool, operands []string) string {
+	var sum int64
+	if exists {
+		sum, _ = strconv.ParseInt(existing, 10, 64)
+	}
+	for _, operand := range operands {
+		n, _ := strconv.ParseInt(operand, 10, 64)
+		sum += n
+	}
+	return strconv.FormatInt(sum, 10)
+}
+
+func (Int64AddOperator) PartialMerge(key string, older string, newer string) (string, bool) {
+	left, _ := strconv.ParseInt(older, 10, 64)
+	right, _ := strconv.ParseInt(newer, 10, 64)
+	return strconv.FormatInt(left+right, 10), true
+}
+
+// 把操作数追加到已有的值后面，相邻的值之间使用Separator分隔
+type StringAppendOperator struct {
+	Separator string
+}
+
+func (o StringAppendOperator) FullMerge(key string, existing string, exists bool, operands []string) string {
+	if exists {
+		operands = append([]string{existing}, operands...)
+	}
+	return strings.Join(operands, o.Separator)
+}
+
+func (o StringAppendOperator) PartialMerge(key string, older string, newer string) (string, bool) {
+	return older + o.Separator + newer, true
+}
+
+// 记录一个合并操作数，它会在读取时通过配置的合并操作符合并到key已有的值上
+func (cf *ColumnFamily) Merge(key string, operand string) error {
+	if cf.mergeOperator == nil {
+		return ErrNoMergeOperator
+	}
+	return cf.write(key, Data{value: operand, kind: typeMerge})
+}
+
+// 查找key在时间戳timestamp时的值，合并操作数会被合并到旧值上，now用于判断数据是否过期，调用者需要持有读锁
+func (cf *ColumnFamily) read(key string, timestamp uint64, now uint64) (string, bool) {
+	value, ok, _ := cf.view().get(key, timestamp, now)
+	return value, ok
+}
+
+// 从时间戳不大于timestamp的最新版本开始，收集所有操作数直到遇到普通的值或者删除标记，然后把它们合并为一个值，
+// 没有配置合并操作符时返回ErrNoMergeOperator
+func foldVersions(operator MergeOperator, key string, versions []Data, timestamp uint64, now uint64) (Data, error) {
+	if operator == nil {
+		return Data{}, ErrNoMergeOperator
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].timestamp > versions[j].timestamp })
+	operands := make([]string, 0)
+	var result Data
+	var existing string
+	var exists bool
+	for i, data := range versions {
+		if data.timestamp > timestamp || (i > 0 && data.timestamp == versions[i-1].timestamp) {
+			continue
+		}
+		if len(operands) == 0 {
+			result.timestamp = data.timestamp
+		}
+		if data.kind != typeMerge {
+			existing, exists = data.value, data.exists(now)
+			break
+		}
+		operands = append(operands, data.value)
+	}
+	// 操作数需要按照从旧到新的顺序应用
+	for i, j := 0, len(operands)-1; i < j; i, j = i+1, j-1 {
+		operands[i], operands[j] = operands[j], operands[i]
+	}
+	result.value = operator.FullMerge(key, existing, exists, operands)
+	result.kind = typeValue
+	return result, nil
+}
+
+// 把同一个key中从新到旧连续的若干个操作数合并为一个操作数，有任何一对无法合并时原样返回
+func partialMergeOperands(operator MergeOperator, key string, operands []Data) []Data {
+	value := operands[len(operands)-1].value
+	for i := len(operands) - 2; i >= 0; i-- {
+		merged, ok := operator.PartialMerge(key, value, operands[i].value)
+		if !ok {
+			return operands
+		}
+		value = merged
+	}
+	return []Data{{value: value, timestamp: operands[0].timestamp, kind: typeMerge}}
+}
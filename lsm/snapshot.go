@@ -0,0 +1,69 @@
+package lsm
+
+import (
+	"sort"
+)
+
+// 快照，固定在创建时刻的时间戳上，通过快照读取到的数据不会受到之后写入的影响
+type Snapshot struct {
+	lsm       *Lsm
+	timestamp uint64 // 快照对应的时间戳，只有时间戳不大于它的记录对快照可见
+}
+
+// 创建一个快照，快照使用完毕之后需要调用Release释放
+func (l *Lsm) NewSnapshot() *Snapshot {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	// 分配一个新的时间戳，之后的写入都会使用更大的时间戳，它同时也作为快照判断数据是否过期的时间
+	snapshot := &Snapshot{lsm: l, timestamp: l.nextTimestamp()}
+	l.snapshotMutex.Lock()
+	l.snapshots[snapshot] = true
+	l.snapshotMutex.Unlock()
+	return snapshot
+}
+
+// 获取所有存活快照的时间戳，按照从新到旧的顺序排列
+func (l *Lsm) liveSnapshots() []uint64 {
+	l.snapshotMutex.Lock()
+	defer l.snapshotMutex.Unlock()
+	timestamps := make([]uint64, 0, len(l.snapshots))
+	for snapshot := range l.snapshots {
+		timestamps = append(timestamps, snapshot.timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] > timestamps[j] })
+	return timestamps
+}
+
+// 快照对应的时间戳，LSM中记录的时间戳是严格递增的，因此它同时也是快照的序列号
+func (s *Snapshot) Sequence() uint64 {
+	return s.timestamp
+}
+
+// 读取快照中默认列族里key对应的值
+func (s *Snapshot) Get(key string) (string, bool) {
+	return s.GetCF(s.lsm.ColumnFamily, key)
+}
+
+// 读取快照中指定列族里key对应的值，快照对所有列族都是一致的
+func (s *Snapshot) GetCF(cf *ColumnFamily, key string) (string, bool) {
+	s.lsm.mutex.RLock()
+	defer s.lsm.mutex.RUnlock()
+	return cf.read(key, s.timestamp, s.timestamp)
+}
+
+// 创建一个遍历快照中默认列族所有数据的迭代器
+func (s *Snapshot) NewIterator() *Iterator {
+	return s.NewIteratorCF(s.lsm.ColumnFamily)
+}
+
+// 创建一个遍历快照中指定列族所有数据的迭代器
+func (s *Snapshot) NewIteratorCF(cf *ColumnFamily) *Iterator {
+	return cf.newIterator(s.timestamp)
+}
+
+// 释放快照，释放之后快照所需要的旧版本数据可以在合并时被清理
+func (s *Snapshot) Release() {
+	s.lsm.snapshotMutex.Lock()
+	defer s.lsm.snapshotMutex.Unlock()
+	delete(s.lsm.snapshots, s)
+}
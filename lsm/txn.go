@@ -0,0 +1,90 @@
+package lsm
+
+import (
+	"errors"
+	"math"
+)
+
+var (
+	ErrConflict = errors.New("transaction conflict: keys read by the transaction have been modified")
+	ErrTxnDone  = errors.New("transaction has already been committed or rolled back")
+)
+
+// 乐观事务，作用于默认列族，读取基于事务开始时的快照，写入在提交之前缓存在事务中，
+// 提交时如果事务读取过的key在事务开始之后被修改过则提交失败
+type Txn struct {
+	lsm      *Lsm
+	snapshot *Snapshot
+	reads    map[string]bool // 事务读取过的key
+	writes   map[string]Data // 事务缓存的写入
+	done     bool
+}
+
+// 开始一个事务，事务结束时需要调用Commit或者Rollback
+func (l *Lsm) BeginTxn() *Txn {
+	return &Txn{
+		lsm:      l,
+		snapshot: l.NewSnapshot(),
+		reads:    make(map[string]bool),
+		writes:   make(map[string]Data),
+	}
+}
+
+// 读取key对应的值，优先读取事务中尚未提交的写入
+func (t *Txn) Get(key string) (string, bool) {
+	if data, ok := t.writes[key]; ok {
+		return data.value, data.kind != typeDeletion
+	}
+	t.reads[key] = true
+	return t.snapshot.Get(key)
+}
+
+// 在事务中保存一组key,value，事务结束之后调用无效
+func (t *Txn) Set(key string, value string) {
+	if !t.done {
+		t.writes[key] = Data{value: value, kind: typeValue}
+	}
+}
+
+// 在事务中删除一个key，事务结束之后调用无效
+func (t *Txn) Delete(key string) {
+	if !t.done {
+		t.writes[key] = Data{kind: typeDeletion}
+	}
+}
+
+// 提交事务，所有的写入作为transLog中的一个条目原子地写入
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	defer t.snapshot.Release()
+
+	l := t.lsm
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	// 检查事务读取过的key在快照之后是否被修改过
+	for key := range t.reads {
+		if data, ok := l.search(key, math.MaxUint64); ok && data.timestamp > t.snapshot.timestamp {
+			return ErrConflict
+		}
+	}
+	if len(t.writes) == 0 {
+		return nil
+	}
+	records := make([]record, 0, len(t.writes))
+	for key, data := range t.writes {
+		records = append(records, record{key, data, defaultColumnFamily})
+	}
+	return l.writeRecords(records)
+}
+
+// 回滚事务，丢弃所有缓存的写入
+func (t *Txn) Rollback() {
+	if t.done {
+		return
+	}
+	t.done = true
+	t.snapshot.Release()
+}
@@ -2,20 +2,22 @@ package lsm
 
 import (
 	"encoding/binary"
-	"io"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"strconv"
 	"strings"
-	"time"
 )
 
 const (
 	thresholdSize         = 1024 * 1024 * 3 // memTable转化为SSTable的大小阈值
 	memTableCheckInterval = 1000 * 3        // 每隔指定的操作次数就检测一次内存表的大小
-	indexOffset           = 1000            // 每隔offset个元素创建一个索引
+	blockSize             = 1024 * 4        // 数据块的大小阈值，每个数据块创建一个索引
+	blockRestartInterval  = 16              // 数据块内每隔指定的记录数设置一个重启点
 	indexFileSuffix       = ".i"            // 索引文件的后缀名(index)
 	segmentFileSuffix     = ".seg"          // 数据文件的后缀名(segment)
 	unavailableFileSuffix = ".ua"           // 数据不可用标签文件的后缀名(unavailable)
@@ -25,8 +27,16 @@ const (
 	transLogAsyncInterval = 1               // transLog异步的落盘时间间隔（秒）
 	waitOldSegFileDelTime = 5               // 旧的段文件被打上废弃标签后等待一段时间再删除该文件（秒）
 	writeLockFile         = "write.lock"    // 写LSM的文件锁
+	metadataFile          = "metadata"      // 元数据文件的名称，保存比较器等需要在多次打开之间保持一致的信息
+	manifestFile          = "manifest"      // 清单文件的名称，记录当前所有可用的段文件
+	pinFileSuffix         = ".pin"          // Reader固定段文件的标记文件的后缀名
+	pinLeaseTime          = 60              // 标记文件在没有被续期时的有效时间（秒），超时之后视为Reader已经退出
+	corruptFileSuffix     = ".corrupt"      // Repair隔离的无法恢复的文件追加的后缀名
+	transLogHeader        = "LSMTLOG\x02"   // transLog文件的头部，最后一个字节是transLog的格式版本
 )
 
+var ErrCorruptTransLog = errors.New("corrupt transLog")
+
 // 在指定目录中是否存在特定的后缀名文件
 func isFileSuffixExist(director string, suffix string) bool {
 	files, err := ioutil.ReadDir(director)
@@ -59,14 +69,61 @@ func getIndexFilesPath(director string) []string {
 	return paths
 }
 
-// 生成新的段文件名
+// 获取所有可用的索引文件的路径，跳过存在对应ua文件的段文件
+func getAvailableIndexFilesPath(director string) []string {
+	paths := make([]string, 0)
+	for _, indexFilePath := range getIndexFilesPath(director) {
+		if _, err := os.Stat(strings.Replace(indexFilePath, indexFileSuffix, unavailableFileSuffix, -1)); !os.IsNotExist(err) {
+			continue
+		}
+		paths = append(paths, indexFilePath)
+	}
+	return paths
+}
+
+// 获取所有存在对应ua文件的段文件的路径
+func getUnavailableSegmentFilesPath(director string) []string {
+	paths := make([]string, 0)
+	for _, indexFilePath := range getIndexFilesPath(director) {
+		if _, err := os.Stat(strings.Replace(indexFilePath, indexFileSuffix, unavailableFileSuffix, -1)); !os.IsNotExist(err) {
+			paths = append(paths, strings.Replace(indexFilePath, indexFileSuffix, segmentFileSuffix, -1))
+		}
+	}
+	return paths
+}
+
+// 获取所有没有索引文件的段文件的路径，跳过带有不可用标志的段文件
+func getUnindexedSegmentFilesPath(director string) []string {
+	files, err := ioutil.ReadDir(director)
+	if err != nil {
+		log.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, file := range files {
+		names[file.Name()] = true
+	}
+	paths := make([]string, 0)
+	for _, file := range files {
+		name := file.Name()
+		if !file.Mode().IsRegular() || !strings.HasSuffix(name, segmentFileSuffix) {
+			continue
+		}
+		base := strings.TrimSuffix(name, segmentFileSuffix)
+		if !names[base+indexFileSuffix] && !names[base+unavailableFileSuffix] {
+			paths = append(paths, path.Join(director, name))
+		}
+	}
+	return paths
+}
+
+// 生成新的段文件名，新的段文件编号总是大于已有的段文件编号，因此段文件名不会被重复使用
 func generateSegmentFileName(path string) string {
 	files, err := ioutil.ReadDir(path)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	names := make(map[int]bool)
+	next := 0
 	for _, file := range files {
 		name := file.Name()
 		if file.Mode().IsRegular() && strings.HasSuffix(name, segmentFileSuffix) {
@@ -75,17 +132,12 @@ func generateSegmentFileName(path string) string {
 			if err != nil {
 				log.Fatal(err)
 			}
-			names[nameInt] = true
-		}
-	}
-	i := 0
-	for {
-		// 如果数字i在文件名中尚不存在，则可以使用
-		if _, ok := names[i]; !ok {
-			return strconv.Itoa(i) + segmentFileSuffix
+			if nameInt >= next {
+				next = nameInt + 1
+			}
 		}
-		i += 1
 	}
+	return strconv.Itoa(next) + segmentFileSuffix
 }
 
 // 从索引文件中获取索引列表
@@ -106,6 +158,13 @@ func uint32ToBytes(num uint32) []byte {
 	return buf
 }
 
+// 在字节数组后追加一个变长编码的整数
+func appendUvarint(buf []byte, num uint64) []byte {
+	varint := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(varint, num)
+	return append(buf, varint[:n]...)
+}
+
 func uint64ToBytes(num uint64) []byte {
 	buf := make([]byte, 8)
 	binary.LittleEndian.PutUint64(buf, num)
@@ -131,6 +190,8 @@ func encodeKeyAndData(key string, data Data) []byte {
 	buf := addBufHead([]byte(key))
 	buf = append(buf, addBufHead([]byte(data.value))...)
 	buf = append(buf, uint64ToBytes(data.timestamp)...) // 时间戳
+	buf = append(buf, data.kind)                        // 记录类型
+	buf = appendUvarint(buf, data.ttl)                  // 存活时长
 	return buf
 }
 
@@ -143,7 +204,75 @@ func decodeKeyAndData(buf []byte) (string, Data, uint32) {
 
 	timestampBuf := buf[:8]
 	timestamp := binary.LittleEndian.Uint64(timestampBuf)
-	return string(keyBuf), Data{value: string(valueBuf), timestamp: timestamp}, keyOffset + valOffset + 8
+	ttl, ttlLength := binary.Uvarint(buf[9:])
+	data := Data{value: string(valueBuf), timestamp: timestamp, kind: buf[8], ttl: ttl}
+	return string(keyBuf), data, keyOffset + valOffset + 9 + uint32(ttlLength)
+}
+
+// 把一组记录编码为transLog中的一个条目：长度(4) + 校验和(4) + 记录，每条记录之前是它所属列族的名称
+func encodeTransLogEntry(records []record) []byte {
+	payload := make([]byte, 0)
+	for _, r := range records {
+		payload = append(payload, addBufHead([]byte(r.family))...)
+		payload = append(payload, encodeKeyAndData(r.key, r.data)...)
+	}
+	buf := uint32ToBytes(uint32(len(payload)))
+	buf = append(buf, uint32ToBytes(crc32.ChecksumIEEE(payload))...)
+	return append(buf, payload...)
+}
+
+// 从字节数组中解码出transLog中的一个条目，返回条目中的记录以及条目的长度，条目不完整时返回false
+func decodeTransLogEntry(buf []byte) ([]record, uint32, bool) {
+	if len(buf) < 8 {
+		return nil, 0, false
+	}
+	length := binary.LittleEndian.Uint32(buf)
+	checksum := binary.LittleEndian.Uint32(buf[4:])
+	if uint64(len(buf)-8) < uint64(length) {
+		return nil, 0, false
+	}
+	payload := buf[8 : 8+length]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, 0, false
+	}
+	records := make([]record, 0)
+	for len(payload) > 0 {
+		family, familyOffset := parseBuf(payload)
+		payload = payload[familyOffset:]
+		key, data, n := decodeKeyAndData(payload)
+		records = append(records, record{key, data, string(family)})
+		payload = payload[n:]
+	}
+	return records, 8 + length, true
+}
+
+// 解码整个transLog文件，返回所有完整的条目以及它们（包括文件头部）的总长度。
+// 没有文件头部的是最初格式的transLog，其中每条记录都属于默认列族并且单独作为一个条目。
+// 进程崩溃时最后一个条目可能没有完整的写入，它会被忽略；中间的条目损坏时返回ErrCorruptTransLog
+func decodeTransLog(logData []byte) ([][]record, int, error) {
+	if !strings.HasPrefix(string(logData), transLogHeader) {
+		if strings.HasPrefix(transLogHeader, string(logData)) {
+			// 文件头部没有完整的写入
+			return nil, 0, nil
+		}
+		entries, valid := decodeLegacyTransLog(logData)
+		return entries, valid, nil
+	}
+	entries := make([][]record, 0)
+	valid := len(transLogHeader)
+	for valid < len(logData) {
+		records, length, ok := decodeTransLogEntry(logData[valid:])
+		if !ok {
+			if len(logData)-valid >= 8 && uint64(len(logData)-valid-8) > uint64(binary.LittleEndian.Uint32(logData[valid:])) {
+				// 校验失败的条目之后还有数据，说明它不是最后一个没有写完的条目
+				return entries, valid, fmt.Errorf("%w: invalid entry at offset %d", ErrCorruptTransLog, valid)
+			}
+			break
+		}
+		entries = append(entries, records)
+		valid += int(length)
+	}
+	return entries, valid, nil
 }
 
 // 从一段字节数组中解析出body
@@ -162,51 +291,6 @@ func parseBuf(buf []byte) ([]byte, uint32) {
 	}
 }
 
-// 从文件中解码出一个字节数组
-func readBuf(file *os.File) []byte {
-	headBuf := make([]byte, 1)
-	_, err := file.Read(headBuf)
-	if err != nil {
-		log.Fatal(err)
-	}
-	head := headBuf[0]
-	if head < 0xff {
-		body := make([]byte, head)
-		_, err := file.Read(body)
-		if err != nil {
-			log.Fatal(err)
-		}
-		return body
-	} else {
-		lengthBuf := make([]byte, 4)
-		_, err := file.Read(lengthBuf)
-		if err != nil {
-			log.Fatal(err)
-		}
-		length := binary.LittleEndian.Uint32(lengthBuf)
-		body := make([]byte, length)
-		_, err = file.Read(body)
-		if err != nil {
-			log.Fatal(err)
-		}
-		return body
-	}
-}
-
-// 从文件中读取一组key和data
-func readKeyAndData(file *os.File) (string, Data) {
-	key := readBuf(file)
-	value := readBuf(file)
-
-	timestampBuf := make([]byte, 8)
-	_, err := file.Read(timestampBuf)
-	if err != nil {
-		log.Fatal(err)
-	}
-	timestamp := binary.LittleEndian.Uint64(timestampBuf)
-	return string(key), Data{value: string(value), timestamp: timestamp}
-}
-
 // 获取指定文件的大小
 func getFileSize(file *os.File) int64 {
 	fileInfo, err := file.Stat()
@@ -216,24 +300,6 @@ func getFileSize(file *os.File) int64 {
 	return fileInfo.Size()
 }
 
-// 获取文件的当前读写位置
-func getCurrentPosition(file *os.File) int64 {
-	// 从当前偏移改变0，还是当前偏移
-	position, err := file.Seek(0, io.SeekCurrent)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return position
-}
-
-// 设置文件的当前读写位置
-func setCurrentPosition(file *os.File, position uint32) {
-	_, err := file.Seek(int64(position), 0)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
 // 找出当前目录最小的两个段文件
 func getTwoSmallFiles(indexFilesPath []string) (string, string) {
 	var low1, low2 int64 = 0, 0
@@ -266,133 +332,94 @@ func getTwoSmallFiles(indexFilesPath []string) (string, string) {
 
 // 为归并操作创建新的目标文件
 func createNewSegFile(director string) *os.File {
-	var segFile *os.File
+	segFile, err := newSegFile(director)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return segFile
+}
+
+// 创建新的段文件以及它的不可用标志文件
+func newSegFile(director string) (*os.File, error) {
 	for {
 		segFilePath := path.Join(director, generateSegmentFileName(director))
 		// 再次检测防止在此期间文件被创建
-		if _, err := os.Stat(segFilePath); os.IsNotExist(err) {
-			// 创建段文件
-			segFile, err = os.Create(segFilePath)
-			if err != nil {
-				log.Fatal(err)
-			}
-			// 创建ua文件
-			uaFilePath := strings.Replace(segFilePath, segmentFileSuffix, unavailableFileSuffix, -1)
-			uaFile, err := os.Create(uaFilePath)
-			if err != nil {
-				log.Fatal(err)
-			}
+		if _, err := os.Stat(segFilePath); !os.IsNotExist(err) {
+			continue
+		}
+		// 创建段文件
+		segFile, err := os.Create(segFilePath)
+		if err != nil {
+			return nil, err
+		}
+		// 创建ua文件
+		uaFile, err := os.Create(strings.Replace(segFilePath, segmentFileSuffix, unavailableFileSuffix, -1))
+		if err == nil {
 			err = uaFile.Close()
-			if err != nil {
-				log.Fatal(err)
-			}
-			break
 		}
+		if err != nil {
+			segFile.Close()
+			os.Remove(segFilePath)
+			return nil, err
+		}
+		return segFile, nil
 	}
-	return segFile
 }
 
 // 进行归并操作
-func merge(source1, source2, target *os.File) {
-	start := time.Now().UnixNano()
-	var err error
-
+// 同一个key的多个版本由filter决定是否保留，连续的合并操作数会被合并，返回创建或者写入文件时的错误
+func merge(source1, source2, target *os.File, compression Compression, comparator Comparator, filter *versionFilter) error {
 	// 创建索引文件
 	indexFilePath := strings.Replace(target.Name(), segmentFileSuffix, indexFileSuffix, -1)
 	indexFile, err := os.Create(indexFilePath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	segFile1Size := getFileSize(source1)
-	segFile2Size := getFileSize(source2)
+	iter1 := newSegmentIterator(source1)
+	iter2 := newSegmentIterator(source2)
+	compactor := newCompactor(filter, newSegmentWriter(target, indexFile, compression))
+	add := compactor.add
 
-	i := uint64(0)
-	var key1, key2 string
-	var data1, data2 Data
+	// ok1和ok2表示两个段文件是否还有尚未写入的记录，key可以是空字符串，因此不能用key是否为空来判断
+	ok1, ok2 := iter1.next(), iter2.next()
 	// 进行归并操作
-	for {
-		var key string // 段文件当前使用的key
-
-		pos1, _ := source1.Seek(0, io.SeekCurrent)
-		pos2, _ := source2.Seek(0, io.SeekCurrent)
-		if pos1 == segFile1Size && pos2 == segFile2Size {
-			break
-		}
-
-		if pos1 < segFile1Size && key1 == "" {
-			key1, data1 = readKeyAndData(source1)
-		}
-		if pos2 < segFile2Size && key2 == "" {
-			key2, data2 = readKeyAndData(source2)
-		}
-		currentOffset := getCurrentPosition(target)
-
-		if key1 == "" {
-			_, err = target.Write(encodeKeyAndData(key2, data2))
-			if err != nil {
-				log.Fatal(err)
-			}
-			key = key2
-			key2 = ""
-		} else if key2 == "" {
-			_, err = target.Write(encodeKeyAndData(key1, data1))
-			if err != nil {
-				log.Fatal(err)
-			}
-			key = key1
-			key1 = "" // 置空表示该值已经被使用
-		} else if key1 < key2 {
-			_, err = target.Write(encodeKeyAndData(key1, data1))
-			if err != nil {
-				log.Fatal(err)
-			}
-			key = key1
-			key1 = ""
-		} else if key2 < key1 {
-			_, err = target.Write(encodeKeyAndData(key2, data2))
-			if err != nil {
-				log.Fatal(err)
-			}
-			key = key2
-			key2 = ""
-		} else { // 相等则需要比较时间戳
-			if data1.timestamp >= data2.timestamp {
-				_, err = target.Write(encodeKeyAndData(key1, data1))
-				if err != nil {
-					log.Fatal(err)
-				}
-				key = key1
-			} else {
-				_, err = target.Write(encodeKeyAndData(key2, data2))
-				if err != nil {
-					log.Fatal(err)
+	for ok1 || ok2 {
+		c := 0
+		if ok1 && ok2 {
+			c = comparator.Compare(iter1.key, iter2.key)
+			if c == 0 { // key相等时时间戳较大的新版本排在前面
+				if iter1.data.timestamp > iter2.data.timestamp {
+					c = -1
+				} else if iter2.data.timestamp > iter1.data.timestamp {
+					c = 1
 				}
-				key = key2
 			}
-			// 一个被正确的保存，另外一个被丢弃
-			key1 = ""
-			key2 = ""
+		} else if ok1 {
+			c = -1
+		} else {
+			c = 1
 		}
 
-		pos1, _ = source1.Seek(0, io.SeekCurrent)
-		pos2, _ = source2.Seek(0, io.SeekCurrent)
-		// 写索引文件
-		if i%indexOffset == 0 || (pos1 == segFile1Size && pos2 == segFile2Size) {
-			_, err = indexFile.Write(addBufHead([]byte(key)))
-			if err != nil {
-				log.Fatal(err)
-			}
-			_, err = indexFile.Write(uint32ToBytes(uint32(currentOffset)))
-			if err != nil {
-				log.Fatal(err)
-			}
+		if c <= 0 {
+			add(iter1.key, iter1.data)
+		} else {
+			add(iter2.key, iter2.data)
+		}
+		if c == 0 { // 同一条记录只保存一次
+			ok2 = iter2.next()
+		}
+		if c <= 0 {
+			ok1 = iter1.next()
+		} else {
+			ok2 = iter2.next()
 		}
-		i += 1
 	}
-	closeFile(indexFile)
-	log.Printf("merge: %s & %s -> %s, cost %dns\n",
-		source1.Name(), source2.Name(), target.Name(), time.Now().UnixNano()-start)
+	err = compactor.finish()
+	if closeErr := indexFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 // 关闭文件
@@ -410,3 +437,41 @@ func removeFile(file string) {
 		log.Fatal(err)
 	}
 }
+
+// 删除文件，文件不存在时不返回错误
+func removeFileIfExists(file string) error {
+	err := os.Remove(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 复制文件
+func copyFile(source string, target string) {
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ioutil.WriteFile(target, data, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// 把数据追加到文件的末尾并同步到磁盘，文件不存在时创建它
+func appendFile(filePath string, data []byte) {
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = file.Sync()
+	if err != nil {
+		log.Fatal(err)
+	}
+	closeFile(file)
+}
@@ -0,0 +1,465 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// 数据文件中的一个问题
+type Problem struct {
+	Path   string // 出现问题的文件
+	Reason string
+}
+
+func (p Problem) String() string {
+	return p.Path + ": " + p.Reason
+}
+
+// Verify和Repair的结果
+type VerifyReport struct {
+	Segments  int       // 检查过的段文件数量
+	Records   int       // 段文件中能够读取的记录数量
+	Problems  []Problem // 发现的问题，对于Repair是修复之前发现的问题
+	Unordered []string  // 使用自定义比较器的目录，无法检查其中key的顺序
+
+	// 以下字段只有Repair会填充
+	Actions []string // 执行过的修复操作
+}
+
+// 是否没有发现任何问题
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyReport) problem(path string, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, Problem{Path: path, Reason: fmt.Sprintf(format, args...)})
+}
+
+func (r *VerifyReport) action(format string, args ...interface{}) {
+	r.Actions = append(r.Actions, fmt.Sprintf(format, args...))
+}
+
+// 离线检查目录以及所有列族目录中的数据文件：段文件中数据块和记录的格式、key的顺序、索引和段文件是否一致、
+// 是否存在孤立的索引文件和不可用标志文件，以及transLog中是否有不完整或者损坏的条目。
+// Verify不会修改任何文件，但是在LSM运行时检查可能会因为文件被修改而报告不存在的问题
+func Verify(director string) (*VerifyReport, error) {
+	directors, err := dataDirectors(director)
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{}
+	for _, dir := range directors {
+		if err := checkDirector(dir, report, false); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// 离线修复目录以及所有列族目录中的数据文件，修复期间持有目录的写锁，LSM运行时返回ErrLocked。
+// 删除孤立的索引文件和不可用标志文件，为缺少索引或者索引不一致的段文件重新生成索引，
+// 把损坏的段文件中能够读取的记录保存到新的段文件中，并在损坏的文件名后追加.corrupt进行隔离，
+// 丢弃transLog末尾不完整的条目，transLog中间的条目损坏时先把它复制为translog.corrupt再丢弃损坏的条目之后的数据。修复之后清单会被重新生成
+func Repair(director string) (*VerifyReport, error) {
+	directors, err := dataDirectors(director)
+	if err != nil {
+		return nil, err
+	}
+	lockFile, err := lockDirector(director)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockDirector(lockFile)
+	report := &VerifyReport{}
+	for _, dir := range directors {
+		if err := checkDirector(dir, report, true); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// LSM的目录以及其中所有列族的目录
+func dataDirectors(director string) ([]string, error) {
+	files, err := ioutil.ReadDir(director)
+	if err != nil {
+		return nil, err
+	}
+	directors := []string{director}
+	for _, file := range files {
+		if file.IsDir() {
+			directors = append(directors, path.Join(director, file.Name()))
+		}
+	}
+	return directors, nil
+}
+
+// 检查一个目录中的数据文件，repair为true时同时进行修复
+func checkDirector(director string, report *VerifyReport, repair bool) error {
+	files, err := ioutil.ReadDir(director)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, file := range files {
+		if file.Mode().IsRegular() {
+			names[file.Name()] = true
+		}
+	}
+	comparator, err := openComparator(director, nil, false)
+	if err != nil {
+		comparator = nil
+		report.Unordered = append(report.Unordered, director)
+	}
+
+	changed := false
+	for _, file := range files {
+		name := file.Name()
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		filePath := path.Join(director, name)
+		base := strings.TrimSuffix(name, path.Ext(name))
+		switch {
+		case strings.HasSuffix(name, indexFileSuffix) && !names[base+segmentFileSuffix]:
+			report.problem(filePath, "index without segment")
+			if repair {
+				removeFile(filePath)
+				report.action("removed orphaned index %s", filePath)
+				changed = true
+			}
+		case strings.HasSuffix(name, unavailableFileSuffix) && !names[base+segmentFileSuffix]:
+			report.problem(filePath, "unavailable flag without segment")
+			if repair {
+				removeFile(filePath)
+				report.action("removed orphaned unavailable flag %s", filePath)
+			}
+		case strings.HasSuffix(name, segmentFileSuffix) && !names[base+unavailableFileSuffix]:
+			// 带有不可用标志的段文件已经被合并或者还没有写完，LSM打开时会删除它们
+			indexFilePath := path.Join(director, base+indexFileSuffix)
+			check := checkSegment(filePath, indexFilePath, comparator)
+			report.Segments += 1
+			report.Records += len(check.entries)
+			report.Problems = append(report.Problems, check.problems...)
+			if repair && repairSegment(director, filePath, indexFilePath, check, comparator, report) {
+				changed = true
+			}
+		case name == transLog:
+			valid, corrupt := checkTransLog(filePath, report)
+			if repair && corrupt {
+				copyFile(filePath, filePath+corruptFileSuffix)
+				report.action("copied %s to %s", filePath, filePath+corruptFileSuffix)
+			}
+			if repair && valid >= 0 {
+				if err := os.Truncate(filePath, valid); err != nil {
+					log.Fatal(err)
+				}
+				report.action("truncated %s to %d bytes", filePath, valid)
+			}
+		}
+	}
+	if changed {
+		writeManifest(director)
+	}
+	return nil
+}
+
+// 检查transLog中的所有条目，存在不完整或者损坏的条目时返回它之前的完整条目的总长度，否则返回-1；
+// 第二个返回值表示是否有条目损坏
+func checkTransLog(transLogFilePath string, report *VerifyReport) (int64, bool) {
+	logData, err := ioutil.ReadFile(transLogFilePath)
+	if err != nil {
+		report.problem(transLogFilePath, "%v", err)
+		return -1, false
+	}
+	_, valid, err := decodeTransLog(logData)
+	if err != nil {
+		report.problem(transLogFilePath, "%v, %d bytes after it", err, len(logData)-valid)
+		return int64(valid), true
+	}
+	if valid < len(logData) {
+		report.problem(transLogFilePath, "%d bytes of incomplete entry at offset %d", len(logData)-valid, valid)
+		return int64(valid), false
+	}
+	return -1, false
+}
+
+// 段文件中的一条记录
+type segmentEntry struct {
+	key  string
+	data Data
+}
+
+// 段文件的检查结果
+type segmentCheck struct {
+	entries  []segmentEntry // 所有能够读取的记录
+	blocks   []Index        // 所有能够读取的数据块的最后一个key以及偏移
+	corrupt  bool           // 是否存在无法读取的数据块或者顺序错误的记录
+	indexOK  bool           // 索引文件是否和段文件一致
+	problems []Problem
+}
+
+func (check *segmentCheck) problem(path string, format string, args ...interface{}) {
+	check.problems = append(check.problems, Problem{Path: path, Reason: fmt.Sprintf(format, args...)})
+}
+
+// 检查段文件中的每个数据块以及它的索引文件，comparator为空时不检查key的顺序
+func checkSegment(segFilePath string, indexFilePath string, comparator Comparator) segmentCheck {
+	var indices []Index
+	var problems []Problem
+	indexOK := false
+	indexData, err := ioutil.ReadFile(indexFilePath)
+	if os.IsNotExist(err) {
+		problems = append(problems, Problem{segFilePath, "segment without index"})
+	} else if err != nil {
+		problems = append(problems, Problem{indexFilePath, err.Error()})
+	} else if indices, err = parseIndex(indexData); err != nil {
+		problems = append(problems, Problem{indexFilePath, "corrupt index: " + err.Error()})
+	} else {
+		indexOK = true
+	}
+
+	check := readSegmentBlocks(segFilePath, indices, comparator)
+	check.problems = append(problems, check.problems...)
+	if check.corrupt {
+		check.indexOK = false
+	} else if indexOK && !sameIndices(indices, check.blocks) {
+		check.problem(indexFilePath, "index does not match segment")
+	} else {
+		check.indexOK = indexOK
+	}
+	return check
+}
+
+// 按顺序读取段文件中的所有数据块，遇到无法读取的数据块时从indices中记录的下一个数据块继续读取，
+// comparator为空时不检查key的顺序
+func readSegmentBlocks(segFilePath string, indices []Index, comparator Comparator) segmentCheck {
+	check := segmentCheck{}
+	problem := check.problem
+	segFile, err := os.Open(segFilePath)
+	if err != nil {
+		problem(segFilePath, "%v", err)
+		check.corrupt = true
+		return check
+	}
+	defer segFile.Close()
+	size := getFileSize(segFile)
+	unordered := false
+	for offset := uint32(0); int64(offset) < size; {
+		raw, length, err := readBlockChecked(segFile, offset, size)
+		var entries []segmentEntry
+		if err == nil {
+			entries, err = decodeBlock(raw)
+		}
+		if err != nil {
+			problem(segFilePath, "corrupt block at offset %d: %v", offset, err)
+			check.corrupt = true
+			// 数据块的边界已经无法确定，从索引中记录的下一个数据块继续读取
+			i := sort.Search(len(indices), func(i int) bool { return indices[i].offset > offset })
+			if i == len(indices) {
+				break
+			}
+			offset = indices[i].offset
+			continue
+		}
+		for _, entry := range entries {
+			if comparator != nil && !unordered && len(check.entries) > 0 && !inOrder(comparator, check.entries[len(check.entries)-1], entry) {
+				problem(segFilePath, "key %q in block at offset %d is out of order", entry.key, offset)
+				check.corrupt, unordered = true, true
+			}
+			check.entries = append(check.entries, entry)
+		}
+		if len(entries) > 0 {
+			check.blocks = append(check.blocks, Index{entries[len(entries)-1].key, offset})
+		}
+		offset += length
+	}
+	return check
+}
+
+// 修复一个段文件，返回是否修改了目录中的段文件
+func repairSegment(director string, segFilePath string, indexFilePath string, check segmentCheck, comparator Comparator, report *VerifyReport) bool {
+	if !check.corrupt {
+		if !check.indexOK {
+			writeIndexFile(indexFilePath, check.blocks)
+			report.action("rebuilt index %s", indexFilePath)
+			return true
+		}
+		return false
+	}
+	if len(check.entries) > 0 {
+		entries := check.entries
+		if comparator != nil {
+			// 恢复记录的顺序，并去掉重复的记录
+			sort.SliceStable(entries, func(i, j int) bool {
+				c := comparator.Compare(entries[i].key, entries[j].key)
+				return c < 0 || (c == 0 && entries[i].data.timestamp > entries[j].data.timestamp)
+			})
+			unique := entries[:1]
+			for _, entry := range entries[1:] {
+				last := unique[len(unique)-1]
+				if entry.key != last.key || entry.data.timestamp != last.data.timestamp {
+					unique = append(unique, entry)
+				}
+			}
+			entries = unique
+		}
+		// 先生成新的段文件再隔离旧的段文件，新的段文件的编号不会和旧的重复
+		segFile := createNewSegFile(director)
+		indexFile, err := os.Create(strings.Replace(segFile.Name(), segmentFileSuffix, indexFileSuffix, -1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		writer := newSegmentWriter(segFile, indexFile, NoCompression)
+		for _, entry := range entries {
+			writer.add(entry.key, entry.data)
+		}
+		if err := writer.finish(); err != nil {
+			log.Fatal(err)
+		}
+		closeFile(segFile)
+		closeFile(indexFile)
+		removeFile(strings.Replace(segFile.Name(), segmentFileSuffix, unavailableFileSuffix, -1))
+		report.action("salvaged %d records from %s into %s", len(entries), segFilePath, segFile.Name())
+	}
+	for _, filePath := range []string{segFilePath, indexFilePath} {
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(filePath, filePath+corruptFileSuffix); err != nil {
+			log.Fatal(err)
+		}
+		report.action("quarantined %s", filePath)
+	}
+	return true
+}
+
+// 读取段文件中指定偏移处的数据块，数据块超出文件范围、无法解压或者长度不一致时返回错误
+func readBlockChecked(file *os.File, offset uint32, size int64) ([]byte, uint32, error) {
+	if int64(offset)+blockHeaderSize > size {
+		return nil, 0, errors.New("truncated block header")
+	}
+	header := make([]byte, blockHeaderSize)
+	if _, err := file.ReadAt(header, int64(offset)); err != nil {
+		return nil, 0, err
+	}
+	compression, rawLength, length := Compression(header[0]), binary.LittleEndian.Uint32(header[1:]), binary.LittleEndian.Uint32(header[5:])
+	if int64(offset)+blockHeaderSize+int64(length) > size {
+		return nil, 0, errors.New("truncated block")
+	}
+	// 损坏的头部可能记录了极大的原始长度，解压之前先检查它能否由压缩后的数据得到，避免分配过多的内存
+	if (compression == NoCompression && rawLength != length) || uint64(rawLength) > uint64(length)*maxCompressionRatio {
+		return nil, 0, errors.New("block length does not match its header")
+	}
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, int64(offset)+blockHeaderSize); err != nil {
+		return nil, 0, err
+	}
+	raw, err := decompressBlock(compression, data, rawLength)
+	if err != nil {
+		return nil, 0, err
+	}
+	if uint32(len(raw)) != rawLength {
+		return nil, 0, errors.New("block length does not match its header")
+	}
+	return raw, blockHeaderSize + length, nil
+}
+
+// 解码数据块中的所有记录，数据块的格式错误时返回错误
+func decodeBlock(raw []byte) (entries []segmentEntry, err error) {
+	// 记录的格式错误会导致越界访问
+	defer func() {
+		if r := recover(); r != nil {
+			entries, err = nil, fmt.Errorf("corrupt record: %v", r)
+		}
+	}()
+	if len(raw) < 4 {
+		return nil, errors.New("block is too short")
+	}
+	numRestarts := binary.LittleEndian.Uint32(raw[len(raw)-4:])
+	if 4+4*uint64(numRestarts) > uint64(len(raw)) {
+		return nil, errors.New("invalid number of restart points")
+	}
+	iter := newBlockIterator(raw)
+	for _, restart := range iter.restarts {
+		if int(restart) >= len(iter.buf) {
+			return nil, errors.New("invalid restart point")
+		}
+	}
+	for iter.next() {
+		entries = append(entries, segmentEntry{iter.key, iter.data})
+	}
+	return entries, nil
+}
+
+// 解析索引文件的内容，格式错误时返回错误
+func parseIndex(data []byte) (indices []Index, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			indices, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+	return getIndexList(data), nil
+}
+
+// 段文件中的记录必须按照key从小到大、同一个key的时间戳从新到旧的顺序排列
+func inOrder(comparator Comparator, prev segmentEntry, entry segmentEntry) bool {
+	c := comparator.Compare(prev.key, entry.key)
+	return c < 0 || (c == 0 && prev.data.timestamp > entry.data.timestamp)
+}
+
+func sameIndices(a []Index, b []Index) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+var ErrCorruptSegment = errors.New("corrupt segment")
+
+// 扫描段文件重新生成它的索引文件，段文件只有索引文件这一个派生文件。
+// 段文件中存在无法读取的数据块时返回ErrCorruptSegment，此时需要使用Repair；不能用于LSM正在写入的段文件
+func RebuildIndex(segFilePath string) error {
+	if !strings.HasSuffix(segFilePath, segmentFileSuffix) {
+		return errors.New("not a segment file: " + segFilePath)
+	}
+	if _, err := os.Stat(segFilePath); err != nil {
+		return err
+	}
+	check := readSegmentBlocks(segFilePath, nil, nil)
+	if check.corrupt {
+		return fmt.Errorf("%w: %s", ErrCorruptSegment, check.problems[0])
+	}
+	writeIndexFile(strings.Replace(segFilePath, segmentFileSuffix, indexFileSuffix, -1), check.blocks)
+	return nil
+}
+
+// 写入索引文件，先写临时文件再重命名，避免留下不完整的索引
+func writeIndexFile(indexFilePath string, indices []Index) {
+	content := make([]byte, 0)
+	for _, index := range indices {
+		content = append(content, addBufHead([]byte(index.key))...)
+		content = append(content, uint32ToBytes(index.offset)...)
+	}
+	tmpFilePath := indexFilePath + ".tmp"
+	err := ioutil.WriteFile(tmpFilePath, content, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.Rename(tmpFilePath, indexFilePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,308 @@
+package lsm
+
+import (
+	"github.com/ryszard/goskiplist/skiplist"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// key的一个历史版本
+type Version struct {
+	Value     string
+	Timestamp time.Time // 版本写入的时间
+	Deleted   bool      // 该版本是否是删除标记
+	ExpiresAt time.Time // 版本过期的时间，为零值表示永不过期
+	Merge     bool      // 该版本是否是尚未合并的合并操作数
+}
+
+// 版本过滤器，决定同一个key的哪些版本需要保留，记录需要按照key升序、时间戳降序依次传入
+type versionFilter struct {
+	snapshots    []uint64 // 存活快照的时间戳
+	maxVersions  int      // 多版本模式下至少保留的最新版本数
+	minTimestamp uint64   // 多版本模式下该时间戳之后写入的旧版本都会被保留
+	versioned    bool     // 是否开启了多版本模式
+	expireBefore uint64   // 在该时间之前过期的记录对任何读取都不可见
+	operator     MergeOperator
+	compaction   bool // 是否在合并段文件，为false时整理的是比所有段文件都新的memTable中的数据
+	comparator   Comparator
+	others       []keyRange // 没有参与合并的段文件的key范围，这些段文件中可能还有同一个key的其他版本
+
+	started       bool
+	key           string
+	count         int    // 当前key已经处理过的版本数
+	prevTimestamp uint64 // 同一个key上一个版本的时间戳
+}
+
+// 根据存活的快照以及多版本模式的配置创建版本过滤器
+func (cf *ColumnFamily) newVersionFilter() *versionFilter {
+	filter := &versionFilter{
+		snapshots:   cf.lsm.liveSnapshots(),
+		maxVersions: cf.maxVersions,
+		versioned:   cf.maxVersions > 0 || cf.versionRetention > 0,
+		operator:    cf.mergeOperator,
+	}
+	if cf.versionRetention > 0 {
+		filter.minTimestamp = uint64(time.Now().Add(-cf.versionRetention).UnixNano())
+	}
+	// 存活快照判断数据是否过期的时间早于当前时间
+	filter.expireBefore = uint64(time.Now().UnixNano())
+	if len(filter.snapshots) > 0 && filter.snapshots[len(filter.snapshots)-1] < filter.expireBefore {
+		filter.expireBefore = filter.snapshots[len(filter.snapshots)-1]
+	}
+	return filter
+}
+
+// 段文件中最小和最大的key
+type keyRange struct {
+	smallest string
+	largest  string
+}
+
+// 创建合并段文件时使用的版本过滤器，inputs为参与合并的段文件，其余可用段文件的key范围用于判断是否能看到key的所有版本
+func (cf *ColumnFamily) newCompactionFilter(inputs []string) *versionFilter {
+	filter := cf.newVersionFilter()
+	filter.compaction = true
+	filter.comparator = cf.comparator
+	merged := make(map[string]bool, len(inputs))
+	for _, segFilePath := range inputs {
+		merged[strings.Replace(segFilePath, segmentFileSuffix, indexFileSuffix, -1)] = true
+	}
+	for _, indexFilePath := range getAvailableIndexFilesPath(cf.path) {
+		if merged[indexFilePath] {
+			continue
+		}
+		if smallest, largest, ok := segmentKeyRange(cf.lsm.blockCache, cf.comparator, indexFilePath); ok {
+			filter.others = append(filter.others, keyRange{smallest, largest})
+		}
+	}
+	return filter
+}
+
+// 判断参与合并的段文件是否包含了key在所有段文件中的版本。
+// 只合并了部分段文件时，其余段文件中可能有时间介于两者之间的版本，操作数不能跨过它们合并到更旧的值上
+func (f *versionFilter) complete(key string) bool {
+	if !f.compaction {
+		return false
+	}
+	for _, r := range f.others {
+		if f.comparator.Compare(key, r.smallest) >= 0 && f.comparator.Compare(key, r.largest) <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 整理同一个key按照时间戳从新到旧排列的所有版本，返回需要保留的记录。
+// 被保留的合并操作数需要它之前的版本才能得到完整的值，因此这些版本也会被保留，直到遇到普通的值或者删除标记；
+// 不被快照或者多版本模式需要的连续操作数会被合并为一个操作数，能够合并到旧值上时则直接合并为普通的值。
+// 合并段文件时只有看到了key的所有版本才会合并操作数
+func (f *versionFilter) compact(key string, versions []Data) []Data {
+	kept := make([]Data, 0, len(versions))
+	needed := make([]bool, 0, len(versions)) // 记录本身是否被读取需要，为false表示只是为了合并操作数而保留
+	for _, data := range versions {
+		keep := f.keep(key, data.timestamp)
+		if !keep && (len(kept) == 0 || kept[len(kept)-1].kind != typeMerge) {
+			continue
+		}
+		kept = append(kept, data)
+		needed = append(needed, keep)
+	}
+	if f.operator == nil || (f.compaction && !f.complete(key)) {
+		return kept
+	}
+
+	result := make([]Data, 0, len(kept))
+	for i := 0; i < len(kept); {
+		if kept[i].kind != typeMerge {
+			result = append(result, kept[i])
+			i += 1
+			continue
+		}
+		j := i + 1
+		for j < len(kept) && !needed[j] && kept[j].kind == typeMerge {
+			j += 1
+		}
+		// 带有存活时长的旧值过期之后操作数需要重新作用在空值上，因此不能提前合并
+		if j < len(kept) && kept[j].kind != typeMerge && kept[j].ttl == 0 {
+			// 配置了合并操作符时不会返回错误
+			folded, _ := foldVersions(f.operator, key, kept[i:j+1], kept[i].timestamp, kept[i].timestamp)
+			result = append(result, folded)
+			if !needed[j] {
+				j += 1
+			}
+		} else {
+			result = append(result, partialMergeOperands(f.operator, key, kept[i:j])...)
+		}
+		i = j
+	}
+	return result
+}
+
+// 判断记录是否需要保留：最新的版本总是保留，旧版本在多版本模式的限制之内，或者是某个快照可见的最新版本时保留
+func (f *versionFilter) keep(key string, timestamp uint64) bool {
+	if !f.started || key != f.key {
+		f.started = true
+		f.key = key
+		f.count = 1
+		f.prevTimestamp = timestamp
+		return true
+	}
+	f.count += 1
+	keep := f.retained(f.count, timestamp)
+	for _, snapshot := range f.snapshots {
+		if timestamp <= snapshot && snapshot < f.prevTimestamp {
+			keep = true
+			break
+		}
+	}
+	f.prevTimestamp = timestamp
+	return keep
+}
+
+// 合并的段文件包含了key的所有版本时，最旧的删除标记（包括过期的值转换成的删除标记）已经没有更旧的版本需要覆盖，
+// 读取时有没有它结果都相同，因此直接清理掉。多版本模式需要把它作为历史版本保留，
+// 或者它比某个存活的快照新（事务提交时需要通过它发现冲突）时仍然保留
+func (f *versionFilter) dropDeletions(versions []Data) []Data {
+	for len(versions) > 0 {
+		last := versions[len(versions)-1]
+		if last.kind != typeDeletion || f.retained(len(versions), last.timestamp) ||
+			(len(f.snapshots) > 0 && f.snapshots[len(f.snapshots)-1] < last.timestamp) {
+			break
+		}
+		versions = versions[:len(versions)-1]
+	}
+	return versions
+}
+
+// 判断多版本模式是否需要保留key的第count新的版本：它是最新的maxVersions个版本之一，或者在保留时长之内写入
+func (f *versionFilter) retained(count int, timestamp uint64) bool {
+	if !f.versioned {
+		return false
+	}
+	return (f.maxVersions > 0 && count <= f.maxVersions) || (f.minTimestamp > 0 && timestamp >= f.minTimestamp)
+}
+
+// 获取key在指定时间的值
+func (cf *ColumnFamily) GetAt(key string, t time.Time) (string, bool) {
+	cf.lsm.mutex.RLock()
+	defer cf.lsm.mutex.RUnlock()
+	return cf.read(key, uint64(t.UnixNano()), uint64(t.UnixNano()))
+}
+
+// 获取key所有保留下来的历史版本，按照从新到旧的顺序排列
+func (cf *ColumnFamily) History(key string) []Version {
+	cf.lsm.mutex.RLock()
+	defer cf.lsm.mutex.RUnlock()
+	return toVersions(cf.versions(key))
+}
+
+// 获取memTable以及段文件中key的所有版本，调用者需要持有读锁
+func (cf *ColumnFamily) versions(key string) []Data {
+	return cf.view().versions(key)
+}
+
+// 获取memTable中key的所有版本
+func memTableVersions(memTable *skiplist.SkipList, key string) []Data {
+	versions := make([]Data, 0)
+	iter := memTable.Seek(internalKey{key, math.MaxUint64})
+	if iter != nil {
+		for ok := true; ok && iter.Key().(internalKey).key == key; ok = iter.Next() {
+			versions = append(versions, iter.Value().(Data))
+		}
+		iter.Close()
+	}
+	return versions
+}
+
+// 压缩器，按照key升序、时间戳降序接收记录，把每个key的所有版本整理之后写入段文件
+type compactor struct {
+	filter   *versionFilter
+	writer   *segmentWriter
+	key      string
+	versions []Data // 当前key已经接收到的版本
+}
+
+func newCompactor(filter *versionFilter, writer *segmentWriter) *compactor {
+	return &compactor{filter: filter, writer: writer}
+}
+
+// 接收一条记录，已经过期的记录会被转换为删除标记，这样既能清理掉它的值，又能继续覆盖该key更旧的版本，
+// 合并的段文件包含了key的所有版本时删除标记也会被清理
+func (c *compactor) add(key string, data Data) {
+	if len(c.versions) > 0 && key != c.key {
+		c.flush()
+	}
+	c.key = key
+	if data.kind == typeValue && data.expired(c.filter.expireBefore) {
+		data = Data{timestamp: data.timestamp, kind: typeDeletion}
+	}
+	c.versions = append(c.versions, data)
+}
+
+// 把当前key需要保留的记录写入段文件
+func (c *compactor) flush() {
+	versions := c.filter.compact(c.key, c.versions)
+	if c.filter.complete(c.key) {
+		versions = c.filter.dropDeletions(versions)
+	}
+	for _, data := range versions {
+		c.writer.add(c.key, data)
+	}
+	c.versions = c.versions[:0]
+}
+
+// 写入剩余的记录并完成段文件，返回写入过程中的第一个错误
+func (c *compactor) finish() error {
+	if len(c.versions) > 0 {
+		c.flush()
+	}
+	return c.writer.finish()
+}
+
+// 获取key在指定时间的值
+func (r *Reader) GetAt(key string, t time.Time) (string, bool) {
+	return r.read(key, uint64(t.UnixNano()), uint64(t.UnixNano()))
+}
+
+// 获取key所有保留下来的历史版本，按照从新到旧的顺序排列
+func (r *Reader) History(key string) []Version {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return toVersions(r.view().versions(key))
+}
+
+// 获取一组段文件中key的所有版本
+func segmentVersions(cache *BlockCache, comparator Comparator, indexFilesPath []string, key string) []Data {
+	versions := make([]Data, 0)
+	for _, indexFilePath := range indexFilesPath {
+		scanSegment(cache, comparator, indexFilePath, key, func(data Data) bool {
+			versions = append(versions, data)
+			return true
+		})
+	}
+	return versions
+}
+
+// 把记录按照时间戳从新到旧排序并去重，转换为历史版本
+func toVersions(records []Data) []Version {
+	sort.Slice(records, func(i, j int) bool { return records[i].timestamp > records[j].timestamp })
+	versions := make([]Version, 0, len(records))
+	for i, data := range records {
+		if i > 0 && data.timestamp == records[i-1].timestamp {
+			continue
+		}
+		version := Version{
+			Value:     data.value,
+			Timestamp: time.Unix(0, int64(data.timestamp)),
+			Deleted:   data.kind == typeDeletion,
+			Merge:     data.kind == typeMerge,
+		}
+		if data.ttl > 0 {
+			version.ExpiresAt = time.Unix(0, int64(data.timestamp+data.ttl))
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
@@ -0,0 +1,271 @@
+package lsm
+
+import (
+	"context"
+	"github.com/ryszard/goskiplist/skiplist"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 一份只读的数据视图，由memTable以及一组段文件组成。
+// Lsm和Reader都通过视图读取数据，两者只是memTable和段文件的来源不同
+type view struct {
+	memTable   *skiplist.SkipList
+	segments   []string // 段文件对应的索引文件
+	blockCache *BlockCache
+	rowCache   *rowCache // 行缓存，为空时不使用
+	comparator Comparator
+	operator   MergeOperator
+	ctx        context.Context // 查找段文件之前检查是否已经被取消，为空时不检查
+
+	segmentReads int // 查找过的段文件数量，用于统计读放大
+}
+
+// 列族当前数据的视图，LSM关闭之后视图中没有任何数据，调用者需要持有读锁
+func (cf *ColumnFamily) view() *view {
+	if cf.lsm.closed {
+		return &view{
+			memTable:   newMemTable(cf.comparator),
+			blockCache: cf.lsm.blockCache,
+			comparator: cf.comparator,
+			operator:   cf.mergeOperator,
+		}
+	}
+	return &view{
+		memTable:   cf.memTable,
+		segments:   getAvailableIndexFilesPath(cf.path),
+		blockCache: cf.lsm.blockCache,
+		rowCache:   cf.rowCache,
+		comparator: cf.comparator,
+		operator:   cf.mergeOperator,
+	}
+}
+
+// Reader最近一次刷新时数据的视图，调用者需要持有读锁
+func (r *Reader) view() *view {
+	return &view{
+		memTable:   r.memTable,
+		segments:   r.segments,
+		blockCache: r.blockCache,
+		comparator: r.comparator,
+		operator:   r.mergeOperator,
+	}
+}
+
+// 查找key时间戳不大于timestamp的最新记录，返回的记录可能是删除标记，只有ctx被取消时才会返回错误
+func (v *view) search(key string, timestamp uint64) (Data, bool, error) {
+	data, ok := searchMemTable(v.memTable, key, timestamp)
+	if ok {
+		return data, true, nil
+	}
+	if v.rowCache == nil || timestamp != math.MaxUint64 {
+		return v.searchSegments(key, timestamp)
+	}
+	// 行缓存命中则无需查询段文件
+	entry, cached, version := v.rowCache.lookup(key)
+	if cached {
+		return entry.data, entry.found, nil
+	}
+	data, ok, err := v.searchSegments(key, timestamp)
+	if err == nil {
+		v.rowCache.fill(key, rowCacheEntry{data: data, found: ok}, version)
+	}
+	return data, ok, err
+}
+
+// 在所有段文件中查找key时间戳不大于timestamp的最新记录，每查找一个段文件之前都检查ctx是否已经被取消
+func (v *view) searchSegments(key string, timestamp uint64) (Data, bool, error) {
+	value, ok := Data{}, false
+	for _, indexFilePath := range v.segments {
+		if v.ctx != nil && v.ctx.Err() != nil {
+			return Data{}, false, v.ctx.Err()
+		}
+		data, found := searchSegment(v.blockCache, v.comparator, indexFilePath, key, timestamp)
+		v.segmentReads += 1
+		if found && (!ok || data.timestamp > value.timestamp) {
+			value, ok = data, true
+		}
+	}
+	return value, ok, nil
+}
+
+// 查找key在时间戳timestamp时的值，合并操作数会被合并到旧值上，now用于判断数据是否过期，
+// 只有ctx被取消或者需要合并操作数但是没有配置合并操作符时才会返回错误
+func (v *view) get(key string, timestamp uint64, now uint64) (string, bool, error) {
+	data, ok, err := v.search(key, timestamp)
+	if err != nil {
+		return "", false, err
+	}
+	if ok && data.kind == typeMerge {
+		data, err = foldVersions(v.operator, key, v.versions(key), timestamp, now)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	// 最新的记录是删除标记或者已经过期则表示值不存在
+	if !ok || !data.exists(now) {
+		return "", false, nil
+	}
+	return data.value, true, nil
+}
+
+// 查找一组key在时间戳timestamp时的值，结果的顺序和keys的顺序一致。
+// memTable和行缓存中找不到的key会按照比较器排序之后批量地在段文件中查找。
+// 需要合并操作数但是没有配置合并操作符的key视为不存在，同时返回ErrNoMergeOperator
+func (v *view) multiGet(keys []string, timestamp uint64, now uint64) ([]string, []bool, error) {
+	useRowCache := v.rowCache != nil && timestamp == math.MaxUint64
+	entries := make(map[string]rowCacheEntry, len(keys))
+	cacheVersions := make(map[string]uint64)
+	pending := make([]string, 0)
+	for _, key := range keys {
+		if _, ok := entries[key]; ok {
+			continue
+		}
+		if data, ok := searchMemTable(v.memTable, key, timestamp); ok {
+			entries[key] = rowCacheEntry{data: data, found: true}
+			continue
+		}
+		if useRowCache {
+			entry, cached, version := v.rowCache.lookup(key)
+			if cached {
+				entries[key] = entry
+				continue
+			}
+			cacheVersions[key] = version
+		}
+		// 先占位，重复的key只需要查找一次
+		entries[key] = rowCacheEntry{}
+		pending = append(pending, key)
+	}
+	sort.Slice(pending, func(i, j int) bool { return v.comparator.Compare(pending[i], pending[j]) < 0 })
+	for i, entry := range searchSegmentsBatch(v.blockCache, v.comparator, v.segments, pending, timestamp) {
+		entries[pending[i]] = entry
+		if useRowCache {
+			v.rowCache.fill(pending[i], entry, cacheVersions[pending[i]])
+		}
+	}
+
+	values := make([]string, len(keys))
+	found := make([]bool, len(keys))
+	var err error
+	for i, key := range keys {
+		entry := entries[key]
+		if entry.found && entry.data.kind == typeMerge {
+			data, foldErr := foldVersions(v.operator, key, v.versions(key), timestamp, now)
+			if foldErr != nil {
+				err = foldErr
+				continue
+			}
+			entry.data = data
+			entries[key] = entry
+		}
+		if entry.found && entry.data.exists(now) {
+			values[i], found[i] = entry.data.value, true
+		}
+	}
+	return values, found, err
+}
+
+// 获取memTable以及段文件中key的所有版本
+func (v *view) versions(key string) []Data {
+	versions := memTableVersions(v.memTable, key)
+	return append(versions, segmentVersions(v.blockCache, v.comparator, v.segments, key)...)
+}
+
+// 创建一个遍历视图中时间戳不大于timestamp的数据的迭代器，memTable中的数据会被复制，段文件会被打开直到迭代器关闭
+func (v *view) newIterator(timestamp uint64) *Iterator {
+	sources := []recordIterator{newMemTableIterator(v.memTable)}
+	files := make([]*os.File, 0)
+	for _, indexFilePath := range v.segments {
+		segFile, err := os.Open(strings.Replace(indexFilePath, indexFileSuffix, segmentFileSuffix, -1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		files = append(files, segFile)
+		sources = append(sources, newSegmentIterator(segFile))
+	}
+	return &Iterator{iter: newMergingIterator(v.comparator, sources), files: files, timestamp: timestamp, operator: v.operator}
+}
+
+// 数据的统计信息
+type Stats struct {
+	Segments        int              // 段文件的数量
+	SegmentBytes    int64            // 段文件占用的空间
+	MemTableEntries int              // memTable中的记录数，对于Reader是从transLog中读取的记录数
+	MemTableBytes   uint64           // memTable中的记录占用的空间
+	Compression     CompressionStats // 段文件的压缩统计信息
+	BlockCache      CacheStats       // 数据块缓存的统计信息
+	RowCache        CacheStats       // 行缓存的统计信息，Reader没有行缓存
+
+	// 以下字段只有Lsm和ColumnFamily会填充
+	Gets          uint64        // Get的次数
+	SegmentReads  uint64        // Get查找段文件的总次数
+	Merges        uint64        // 合并的次数，包括后台合并和手动合并
+	MergeDuration time.Duration // 合并的总耗时
+	MergeBytes    uint64        // 合并生成的段文件的总大小
+
+	// 以下字段只有Lsm.Stats和Reader.Stats会填充
+	TransLogBytes int64 // transLog的大小，对于Reader是最近一次刷新时读取的transLog的大小，没有开启TailTransLog时为0
+
+	// 以下字段只有Lsm.Stats会填充
+	Flushes       uint64           // memTable同步到段文件的次数
+	FlushDuration time.Duration    // 同步memTable的总耗时
+	Families      map[string]Stats // 每个列族各自的统计信息
+}
+
+// 读放大，即平均每次Get需要查找的段文件数量
+func (s Stats) ReadAmplification() float64 {
+	if s.Gets == 0 {
+		return 0
+	}
+	return float64(s.SegmentReads) / float64(s.Gets)
+}
+
+// 不包括需要读取所有数据块头部的压缩统计信息，调用者应该在释放锁之后再通过getCompressionStats获取
+func (v *view) stats() Stats {
+	stats := Stats{
+		Segments:        len(v.segments),
+		SegmentBytes:    getSegmentBytes(v.segments),
+		MemTableEntries: v.memTable.Len(),
+		MemTableBytes:   getMemTableSize(v.memTable),
+		BlockCache:      v.blockCache.Stats(),
+	}
+	if v.rowCache != nil {
+		stats.RowCache = v.rowCache.stats()
+	}
+	return stats
+}
+
+// 获取一组段文件占用的空间
+func getSegmentBytes(indexFilesPath []string) int64 {
+	var size int64
+	for _, indexFilePath := range indexFilesPath {
+		info, err := os.Stat(strings.Replace(indexFilePath, indexFileSuffix, segmentFileSuffix, -1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		size += info.Size()
+	}
+	return size
+}
+
+// 使用迭代器依次访问[start, end)范围内的key，start为空表示从第一个key开始，end为空表示没有上界，
+// visit返回false时停止遍历
+func scan(iter *Iterator, comparator Comparator, start string, end string, visit func(key string, value string) bool) {
+	defer iter.Close()
+	for iter.Next() {
+		if start != "" && comparator.Compare(iter.Key(), start) < 0 {
+			continue
+		}
+		if end != "" && comparator.Compare(iter.Key(), end) >= 0 {
+			return
+		}
+		if !visit(iter.Key(), iter.Value()) {
+			return
+		}
+	}
+}
@@ -30,6 +30,22 @@ case $1 in
 	    rm write.lock
     fi
 
+    if [[ -e "metadata" ]]
+    then
+	    rm metadata
+    fi
+
+    if [[ -e "manifest" ]]
+    then
+	    rm manifest
+    fi
+
+    pinArray=(`find ./ -maxdepth 1 -name "*.pin"`)
+    if [[ ${#pinArray[@]} -gt 0 ]]
+    then
+        rm *.pin
+    fi
+
     ;;
 *)
     echo 'Unknown command'